@@ -22,18 +22,49 @@ func main() {
 
 	fmt.Print("fetching...")
 
+	// handlers wrapped in RequireAuth only run for logged in users and can
+	// read them with forum.CurrentUser; WithUser makes it optional
 	http.HandleFunc("/register", forum.RegisterHandler)
 	http.HandleFunc("/login", forum.LoginHandler)
-	http.HandleFunc("/", forum.HomeHandler)
-	http.HandleFunc("/create-post", forum.CreatePostHandler)
-	http.HandleFunc("/post/", forum.PostPageHandler)
-	http.HandleFunc("/post-comment/", forum.PostCommentHandler)
-	http.HandleFunc("/post-like/", forum.HandleLikesDislikes)
-	http.HandleFunc("/comment-like/", forum.CommentLikesHandler)
-	http.HandleFunc("/filtered-posts", forum.FilteredPostsHandler)
+	http.HandleFunc("/login/2fa", forum.LoginTwoFactorHandler)
+	http.HandleFunc("/auth/", forum.OAuthHandler)
+	http.HandleFunc("/", forum.WithUser(forum.HomeHandler))
+	http.HandleFunc("/create-post", forum.RequireAuth(forum.RequireVerified(forum.RequirePermission(forum.PermPostCreate, forum.CreatePostHandler))))
+	http.HandleFunc("/post/", forum.WithUser(forum.PostPageHandler))
+	http.HandleFunc("/post-comment/", forum.RequireAuth(forum.RequireVerified(forum.RequirePermission(forum.PermCommentCreate, forum.PostCommentHandler))))
+	http.HandleFunc("/post-like/", forum.RequireAuth(forum.RequireVerified(forum.RequirePermission(forum.PermReactionCreate, forum.HandleLikesDislikes))))
+	http.HandleFunc("/comment-like/", forum.RequireAuth(forum.RequireVerified(forum.RequirePermission(forum.PermReactionCreate, forum.CommentLikesHandler))))
+	http.HandleFunc("/post-lock/", forum.RequireAuth(forum.RequirePermission(forum.PermPostLock, forum.LockPostHandler)))
+	http.HandleFunc("/post-edit/", forum.RequireAuth(forum.RequireVerified(forum.EditPostHandler)))
+	http.HandleFunc("/post-delete/", forum.RequireAuth(forum.DeletePostHandler))
+	http.HandleFunc("/post-revisions/", forum.WithUser(forum.PostRevisionsHandler))
+	http.HandleFunc("/comment-edit/", forum.RequireAuth(forum.RequireVerified(forum.EditCommentHandler)))
+	http.HandleFunc("/comment-delete/", forum.RequireAuth(forum.DeleteCommentHandler))
+	http.HandleFunc("/comment-hide/", forum.RequireAuth(forum.RequirePermission(forum.PermCommentHide, forum.HideCommentHandler)))
+	http.HandleFunc("/filtered-posts", forum.WithUser(forum.FilteredPostsHandler))
+	http.HandleFunc("/api/posts", forum.WithUser(forum.PostsAPIHandler))
+	http.HandleFunc("/search", forum.WithUser(forum.SearchHandler))
+	http.HandleFunc("/user/", forum.WithUser(forum.ProfileHandler))
+	http.HandleFunc("/api/search", forum.SearchAPIHandler)
+	http.HandleFunc("/categories/create", forum.RequireAuth(forum.RequirePermission(forum.PermCategoryCreate, forum.CreateCategoryHandler)))
 	http.HandleFunc("/logout", forum.LogoutHandler)
+	http.HandleFunc("/styles.css", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "styles.css")
+	})
+	http.HandleFunc("/forgot-password", forum.ForgotPasswordHandler)
+	http.HandleFunc("/reset-password", forum.ResetPasswordHandler)
+	http.HandleFunc("/verify-email", forum.VerifyEmailHandler)
+	http.HandleFunc("/resend-verification", forum.RequireAuth(forum.ResendVerificationHandler))
+	http.HandleFunc("/account/2fa", forum.RequireAuth(forum.TwoFactorHandler))
+	http.HandleFunc("/account/2fa/enable", forum.RequireAuth(forum.EnableTwoFactorHandler))
+	http.HandleFunc("/account/2fa/disable", forum.RequireAuth(forum.DisableTwoFactorHandler))
+	http.HandleFunc("/admin/users", forum.RequireAuth(forum.RequirePermission(forum.PermUserBan, forum.AdminUsersHandler)))
+	http.HandleFunc("/admin/users/role", forum.RequireAuth(forum.RequirePermission(forum.PermUserSetRole, forum.SetRoleHandler)))
+	http.HandleFunc("/admin/users/ban", forum.RequireAuth(forum.RequirePermission(forum.PermUserBan, forum.BanUserHandler)))
+	http.HandleFunc("/admin/users/2fa/disable", forum.RequireAuth(forum.RequirePermission(forum.PermUserResetTwoFactor, forum.ResetTwoFactorHandler)))
 	// http.HandleFunc("/display-dislike-count", forum.DisplayDislikeCountHandler)
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// every non-GET request must carry the page's CSRF token
+	log.Fatal(http.ListenAndServe(":8080", forum.CSRFProtect(http.DefaultServeMux)))
 	forum.Shutdown()
 }
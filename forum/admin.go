@@ -0,0 +1,161 @@
+package forum
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const bannedMessage = "This account has been banned."
+
+// a row in the user management table
+type adminUserRow struct {
+	ID          int
+	Email       string
+	Username    string
+	Role        Role
+	Banned      bool
+	TOTPEnabled bool
+	Karma       int
+	CanAct      bool // the viewer may ban this user or change their role
+}
+
+// list users with forms to change roles, ban and reset 2FA
+func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := DB.Query("SELECT ID, Email, Username, Role, Banned, TOTPEnabled, Karma FROM Users ORDER BY ID")
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var data struct {
+		PageBase
+		Users []adminUserRow
+		Roles []Role
+		// email addresses are only shown to those who can set roles
+		ShowEmail bool
+	}
+	data.PageBase = newPageBase(r)
+	data.Roles = Roles
+	current := CurrentUser(r)
+	data.ShowEmail = current.Can(PermUserSetRole)
+
+	for rows.Next() {
+		var u adminUserRow
+		if err := rows.Scan(&u.ID, &u.Email, &u.Username, &u.Role, &u.Banned, &u.TOTPEnabled, &u.Karma); err != nil {
+			log.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !data.ShowEmail {
+			u.Email = ""
+		}
+		u.CanAct = canActOn(current, u.ID, u.Role)
+		data.Users = append(data.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, "adminUsers.html", data)
+}
+
+// targetUser reads the user_id form field of an admin action. Nobody can
+// act on themselves or on someone with a role at least as high as theirs,
+// unless they are an administrator.
+func targetUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	id, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil, false
+	}
+	target, err := getUserByID(id)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	current := CurrentUser(r)
+	if target.ID == current.ID {
+		http.Error(w, "You cannot change your own account here", http.StatusForbidden)
+		return nil, false
+	}
+	if !canActOn(current, target.ID, target.Role) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return target, true
+}
+
+// canActOn reports whether the user may use the admin actions on another
+// user: never on themselves, and only on lower roles unless they are an
+// administrator
+func canActOn(u *User, targetID int, targetRole Role) bool {
+	if u.ID == targetID {
+		return false
+	}
+	return u.Role == RoleAdministrator || targetRole.rank() < u.Role.rank()
+}
+
+// give a user another role
+func SetRoleHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	role := Role(r.FormValue("role"))
+	if !role.valid() {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := DB.Exec("UPDATE Users SET Role = ? WHERE ID = ?", role, target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not change role", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// ban or unban a user; banning also ends all their sessions
+func BanUserHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	banned := r.FormValue("action") == "ban"
+
+	if _, err := DB.Exec("UPDATE Users SET Banned = ? WHERE ID = ?", banned, target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not ban user", http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		if err := Sessions.DestroyAll(target.ID); err != nil {
+			log.Println("Error clearing sessions:", err)
+		}
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// turn off 2FA for a user who lost their device and recovery codes
+func ResetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	if err := disableTOTP(target.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
@@ -0,0 +1,81 @@
+package forum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func createTestUserWithRole(t *testing.T, name string, role Role) int {
+	t.Helper()
+	id := createTestUser(t, name+"@example.test", name, "password1", true)
+	if _, err := DB.Exec("UPDATE Users SET Role = ? WHERE ID = ?", role, id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// adminRow returns the table row of the users page for a user ID
+func adminRow(t *testing.T, page string, id int) string {
+	t.Helper()
+	re := regexp.MustCompile(`(?s)<tr>\s*<td>` + strconv.Itoa(id) + `</td>.*?</tr>`)
+	row := re.FindString(page)
+	if row == "" {
+		t.Fatalf("no row for user %d", id)
+	}
+	return row
+}
+
+func TestAdminUsersPage(t *testing.T) {
+	openTestDB(t)
+	adminID := createTestUserWithRole(t, "admin1", RoleAdministrator)
+	modID := createTestUserWithRole(t, "mod1", RoleModerator)
+	otherModID := createTestUserWithRole(t, "mod2", RoleModerator)
+	userID := createTestUserWithRole(t, "user1", RoleUser)
+
+	view := func(viewerID int) string {
+		w := httptest.NewRecorder()
+		asUser(t, viewerID, AdminUsersHandler)(w, httptest.NewRequest(http.MethodGet, "/admin/users", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	page := view(modID)
+	if strings.Contains(page, "@example.test") || strings.Contains(page, "<th>Email</th>") {
+		t.Error("a moderator can see email addresses")
+	}
+	for _, tt := range []struct {
+		id      int
+		actions bool
+	}{
+		{adminID, false}, {otherModID, false}, {modID, false}, {userID, true},
+	} {
+		if got := strings.Contains(adminRow(t, page, tt.id), "/admin/users/ban"); got != tt.actions {
+			t.Errorf("moderator sees ban form for user %d: %v, want %v", tt.id, got, tt.actions)
+		}
+	}
+	if strings.Contains(page, "/admin/users/role") {
+		t.Error("a moderator sees role forms")
+	}
+
+	page = view(adminID)
+	if !strings.Contains(adminRow(t, page, userID), "user1@example.test") {
+		t.Error("an administrator cannot see email addresses")
+	}
+	for _, tt := range []struct {
+		id      int
+		actions bool
+	}{
+		{adminID, false}, {modID, true}, {userID, true},
+	} {
+		row := adminRow(t, page, tt.id)
+		if got := strings.Contains(row, "/admin/users/ban") && strings.Contains(row, "/admin/users/role"); got != tt.actions {
+			t.Errorf("administrator sees forms for user %d: %v, want %v", tt.id, got, tt.actions)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package forum
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// a post as the JSON API returns it
+type apiPost struct {
+	ID      string    `json:"id"`
+	Title   string    `json:"title"`
+	Content string    `json:"content"`      // Markdown source
+	HTML    string    `json:"content_html"` // rendered and sanitized
+	Author  string    `json:"author"`
+	Created time.Time `json:"created"`
+	URL     string    `json:"url"`
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// list posts as JSON, taking the same filters as /filtered-posts
+func PostsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parsePostFilter(r)
+	if err == errLoginRequired {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pg, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := getFilteredPosts(filter, pg)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not fetch posts", http.StatusInternalServerError)
+		return
+	}
+
+	// pass next or prev back as after or before to get the next page
+	out := struct {
+		Posts []apiPost `json:"posts"`
+		Next  string    `json:"next,omitempty"`
+		Prev  string    `json:"prev,omitempty"`
+	}{Posts: []apiPost{}, Next: page.Next, Prev: page.Prev}
+	for _, p := range page.Posts {
+		out.Posts = append(out.Posts, apiPost{ID: p.ID, Title: p.Title, Content: p.Content, HTML: string(p.ContentHTML), Author: p.Author, Created: p.Time, URL: p.URL})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,153 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// a category posts can be filed under. Name is used in URLs and forms,
+// Label is shown to people.
+type Category struct {
+	ID    int
+	Name  string
+	Label string
+}
+
+var categoryNamePattern = regexp.MustCompile(`^[a-z0-9-]{1,30}$`)
+
+var errUnknownCategory = errors.New("unknown category")
+
+// getCategories lists every category in label order
+func getCategories() ([]Category, error) {
+	rows, err := DB.Query("SELECT id, name, label FROM categories ORDER BY label COLLATE NOCASE")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Label); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// getPostCategories lists the categories a post is filed under
+func getPostCategories(postID string) ([]Category, error) {
+	rows, err := DB.Query(`SELECT c.id, c.name, c.label FROM categories c
+		JOIN post_categories pc ON pc.category_id = c.id
+		WHERE pc.post_id = ? ORDER BY c.label COLLATE NOCASE`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []Category
+	for rows.Next() {
+		var c Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.Label); err != nil {
+			return nil, err
+		}
+		categories = append(categories, c)
+	}
+	return categories, rows.Err()
+}
+
+// setPostCategories files a post under the named categories
+func setPostCategories(tx *sql.Tx, postID int64, names []string) error {
+	for _, name := range names {
+		res, err := tx.Exec(`INSERT OR IGNORE INTO post_categories (post_id, category_id)
+			SELECT ?, id FROM categories WHERE name = ?`, postID, name)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM categories WHERE name = ?)", name).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return errUnknownCategory
+			}
+		}
+	}
+	return nil
+}
+
+// backfillPostCategories moves the comma-separated names in
+// posts.category_id into post_categories, creating any category that was
+// not seeded
+func backfillPostCategories(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, category_id FROM posts WHERE category_id IS NOT NULL AND category_id != ''")
+	if err != nil {
+		return err
+	}
+	links := map[int64][]string{}
+	for rows.Next() {
+		var id int64
+		var names string
+		if err := rows.Scan(&id, &names); err != nil {
+			rows.Close()
+			return err
+		}
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				links[id] = append(links[id], name)
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, names := range links {
+		for _, name := range names {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO categories (name, label) VALUES (?, ?)", name, name); err != nil {
+				return err
+			}
+		}
+		if err := setPostCategories(tx, id, names); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add a category; its name must be new and URL-friendly
+func CreateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(r.FormValue("name")))
+	label := strings.TrimSpace(r.FormValue("label"))
+	if label == "" {
+		label = name
+	}
+	if !categoryNamePattern.MatchString(name) || len(label) > 50 {
+		http.Error(w, "Category names are 1-30 lowercase letters, digits and dashes, with a label of up to 50 characters", http.StatusBadRequest)
+		return
+	}
+
+	_, err := DB.Exec("INSERT INTO categories (name, label) VALUES (?, ?)", name, label)
+	if isUniqueViolation(err) {
+		http.Error(w, "A category with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not create category", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,152 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shown in place of comments that were removed
+const (
+	deletedCommentText = "[deleted]"
+	hiddenCommentText  = "[hidden by a moderator]"
+)
+
+var errCommentNotFound = errors.New("comment not found")
+
+// getCommentByID loads a comment that has not been deleted and whose post
+// still exists
+func getCommentByID(commentID string) (*Comment, error) {
+	var c Comment
+	err := DB.QueryRow(`SELECT c.id, COALESCE(c.user_id, 0), c.post_id, c.content, c.created_at, c.hidden
+		FROM comments c JOIN posts p ON p.id = c.post_id
+		WHERE c.id = ? AND c.deleted_at IS NULL AND p.deleted_at IS NULL`, commentID).
+		Scan(&c.ID, &c.UserID, &c.PostID, &c.Content, &c.Time, &c.Hidden)
+	if err == sql.ErrNoRows {
+		return nil, errCommentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// commentForAction loads the comment whose ID follows prefix in the URL and
+// checks the current user may act on it with the own/any permission pair
+func commentForAction(w http.ResponseWriter, r *http.Request, prefix, own, any string) (*Comment, bool) {
+	comment, err := getCommentByID(strings.TrimPrefix(r.URL.Path, prefix))
+	if err == errCommentNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !canModify(CurrentUser(r), comment.UserID, own, any) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return comment, true
+}
+
+// commentURL links to a comment on its post's page
+func commentURL(c *Comment) string {
+	return "/post/" + c.PostID + "#comment-" + strconv.Itoa(c.ID)
+}
+
+// edit the text of a comment
+func EditCommentHandler(w http.ResponseWriter, r *http.Request) {
+	comment, ok := commentForAction(w, r, "/comment-edit/", PermCommentEditOwn, PermCommentEditAny)
+	if !ok {
+		return
+	}
+
+	var data struct {
+		PageBase
+		Comment *Comment
+		PostURL string
+		Error   string
+	}
+	data.PageBase = newPageBase(r)
+	data.Comment = comment
+	data.PostURL = commentURL(comment)
+
+	if r.Method == http.MethodGet {
+		renderTemplate(w, "editComment.html", data)
+		return
+	}
+
+	comment.Content = r.FormValue("commentContent")
+	if comment.Content == "" {
+		data.Error = "Please ensure comment box is not empty!"
+	} else {
+		data.Error = validateLength("Comments", comment.Content, commentMaxLength)
+	}
+	if data.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "editComment.html", data)
+		return
+	}
+
+	now := time.Now()
+	_, err := DB.Exec("UPDATE comments SET content = ?, content_html = ?, content_html_version = ?, edited_at = ?, updated_at = ? WHERE id = ?",
+		comment.Content, renderMarkdown(comment.Content), markdownVersion, now, now, comment.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not edit comment", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, commentURL(comment), http.StatusSeeOther)
+}
+
+// soft-delete a comment, leaving a placeholder in the discussion
+func DeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	comment, ok := commentForAction(w, r, "/comment-delete/", PermCommentDeleteOwn, PermCommentDeleteAny)
+	if !ok {
+		return
+	}
+
+	_, err := DB.Exec("UPDATE comments SET deleted_at = ?, deleted_by = ? WHERE id = ?", time.Now(), CurrentUser(r).ID, comment.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not delete comment", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, commentURL(comment), http.StatusSeeOther)
+}
+
+// hide or unhide a comment; moderators can still read hidden comments
+func HideCommentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	comment, err := getCommentByID(strings.TrimPrefix(r.URL.Path, "/comment-hide/"))
+	if err == errCommentNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	hidden := r.FormValue("action") == "hide"
+	if _, err := DB.Exec("UPDATE comments SET hidden = ? WHERE id = ?", hidden, comment.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not hide comment", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, commentURL(comment), http.StatusSeeOther)
+}
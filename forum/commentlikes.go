@@ -1,174 +1,57 @@
 package forum
 
 import (
-	"database/sql"
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-func getCommentPostID(w http.ResponseWriter, r *http.Request) int {
+// like or dislike the comment named by the comment_id form field. The URL
+// carries the post, and the comment has to belong to it.
+func CommentLikesHandler(w http.ResponseWriter, r *http.Request) {
 	// Extract post ID from URL
 	postIDStr := strings.TrimPrefix(r.URL.Path, "/comment-like/")
-	postID, err := strconv.Atoi(postIDStr)
-	if err != nil {
+	if _, err := strconv.Atoi(postIDStr); err != nil {
 		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		return
 	}
-	return postID
-}
 
-// get comment ID
-func getCommentID(postID int) (int, error) {
-	query := "SELECT id FROM comments WHERE post_id = ?"
-	var commentID int
-	err := DB.QueryRow(query, postID).Scan(&commentID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil // Return 0 for no comment found, without an error
-		}
-		return 0, err
+	// Deleted comments and comments on deleted posts are not found
+	comment, err := getCommentByID(r.FormValue("comment_id"))
+	if err == errCommentNotFound || (err == nil && comment.PostID != postIDStr) {
+		http.Error(w, errCommentNotFound.Error(), http.StatusNotFound)
+		return
 	}
-	return commentID, nil
-}
-
-func CommentLikesHandler(w http.ResponseWriter, r *http.Request) {
-	checkCookies(w, r)
-
-	postID = getCommentPostID(w, r)
-	fmt.Println(postID)
-	userID = getUserID(w, r)
-	fmt.Println(userID)
-	commentID, err := getCommentID(postID)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
 	}
-	fmt.Println(commentID)
-
-	r.ParseForm()
-	action := r.FormValue("comment-action")
 
-	// Check if the user has already liked/disliked the post
-	_, _, _ = checkCommentLikeDislike(userID, postID, commentID)
+	kind := r.FormValue("comment-action")
+	allowed, err := canReactWith(CurrentUser(r), targetComment, comment.ID, kind)
 	if err != nil {
-		http.Error(w, "Error checking user like/dislike", http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-
-	// Handle the like/dislike action based on user's previous interaction
-	if action == "like" {
-		err = addCommentLike(userID, postID, commentID)
-		if err != nil {
-			http.Error(w, "Error adding like", http.StatusInternalServerError)
-			return
-		}
-	} else if action == "dislike" {
-		err = addCommentDislike(userID, postID, commentID)
-		if err != nil {
-			http.Error(w, "Error adding dislike", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	fmt.Println("Comment Like/Dislike successful!")
-
-	// Redirect back to the post page
-	postIDStr := strings.TrimPrefix(r.URL.Path, "/comment-like/")
-	http.Redirect(w, r, "/post/"+postIDStr, http.StatusSeeOther)
-}
-
-// check if user has previously liked or disliked a comment
-func checkCommentLikeDislike(userID string, postID int, commentID int) (liked bool, disliked bool, err error) {
-	// check user id, post id and comment id for whether they've previously liked or disliked the post
-	row := DB.QueryRow("SELECT COUNT(*) FROM reactions WHERE user_id = ? AND post_id = ? AND comment_id = ? AND type = 1", userID, postID, commentID)
-	var likeCount int
-	if err := row.Scan(&likeCount); err != nil {
-		return false, false, err
-	}
-	liked = likeCount > 0
-
-	row = DB.QueryRow("SELECT COUNT(*) FROM reactions WHERE user_id = ? AND post_id = ? AND comment_id = ? AND type = -1", userID, postID, commentID)
-	var dislikeCount int
-	if err := row.Scan(&dislikeCount); err != nil {
-		return false, false, err
-	}
-	disliked = dislikeCount > 0
-
-	// check for data entries that have not been liked or disliked
-	row = DB.QueryRow("SELECT COUNT(*) FROM reactions WHERE user_id = ? AND post_id = ? AND comment_id = ? AND type = 0", userID, postID, commentID)
-	var neitherCount int
-	if err := row.Scan(&neitherCount); err != nil {
-		return false, false, err
-	}
-
-	// If there is a "neither" entry, treat it as a like and a dislike
-	if neitherCount > 0 {
-		liked = true
-		disliked = true
-	}
-	return liked, disliked, nil
-}
-
-func addCommentLike(userID string, postID int, commentID int) error {
-	fmt.Println("addCommentLike function triggered")
-	existingLike, existingDislike, err := checkCommentLikeDislike(userID, postID, commentID)
-	if err != nil {
-		return err
+	if !allowed {
+		http.Error(w, "You need more karma to downvote", http.StatusForbidden)
+		return
 	}
 
-	if existingDislike {
-		// Replace value '-1' with '1'
-		_, err = DB.Exec("UPDATE reactions SET type = 1 WHERE user_id = ? AND post_id = ? AND comment_id = ?", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Replaced Dislike with Like")
-	} else if existingLike {
-		// Toggle value '1' to '0'
-		_, err = DB.Exec("UPDATE reactions SET type = 0 WHERE user_id = ? AND post_id = ? AND comment_id = ?", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Toggled Like to Neither")
-	} else {
-		// Insert new entry with value '1'
-		_, err = DB.Exec("INSERT INTO reactions (user_id, post_id, comment_id, type) VALUES (?, ?, ?, 1)", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Added Like")
+	err = ToggleReaction(getUserID(r), targetComment, comment.ID, kind)
+	if err == ErrUnknownReaction {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	return nil
-}
-
-func addCommentDislike(userID string, postID int, commentID int) error {
-	existingLike, existingDislike, err := checkCommentLikeDislike(userID, postID, commentID)
 	if err != nil {
-		return err
+		log.Println(err)
+		http.Error(w, "Could not save reaction", http.StatusInternalServerError)
+		return
 	}
 
-	if existingLike {
-		// Replace value '1' with '-1'
-		_, err = DB.Exec("UPDATE reactions SET type = -1 WHERE user_id = ? AND post_id = ? AND comment_id = ?", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Replaced Like with Dislike")
-	} else if existingDislike {
-		// Toggle value '-1' to '0'
-		_, err = DB.Exec("UPDATE reactions SET type = 0 WHERE user_id = ? AND post_id = ? AND comment_id = ?", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Toggled Dislike to Neither")
-	} else {
-		// Insert new entry with value '-1'
-		_, err = DB.Exec("INSERT INTO reactions (user_id, post_id, comment_id, type) VALUES (?, ?, ?, -1)", userID, postID, commentID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Added Dislike")
-	}
-	return nil
+	// Redirect back to the comment
+	http.Redirect(w, r, commentURL(comment), http.StatusSeeOther)
 }
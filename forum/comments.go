@@ -1,6 +1,7 @@
 package forum
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,11 +10,11 @@ import (
 	"time"
 )
 
+// how deeply replies may nest; 0 turns replies off (FORUM_MAX_COMMENT_DEPTH)
+var MaxCommentDepth = 4
+
 // CREATE COMMENTS FUNCTION
 func PostCommentHandler(w http.ResponseWriter, r *http.Request) {
-	// Check session cookie
-	checkCookies(w, r)
-
 	// Get postID from URL path
 	postIDStr := strings.TrimPrefix(r.URL.Path, "/post-comment/")
 	postID, err := strconv.Atoi(postIDStr)
@@ -22,10 +23,16 @@ func PostCommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve the sessionID and userID from the cookie
-	_, userId, err := GetCookieValue(r)
+	// The logged in user is put in the context by RequireAuth
+	userId := CurrentUser(r).ID
+
+	post, err := getPostByID(postIDStr)
 	if err != nil {
-		http.Error(w, "cookie not found", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if post.Locked {
+		http.Error(w, "This post is locked", http.StatusForbidden)
 		return
 	}
 
@@ -36,32 +43,67 @@ func PostCommentHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	postComment := r.Form.Get("commentContent")
-	fmt.Println(postComment)
 
 	if postComment == "" {
 		fmt.Fprintln(w, "Error - please ensure comment box is not empty!")
 		return
 	}
-
-	dateCreated := time.Now()
-	fmt.Println(userId)
-	userIdInt, err := strconv.Atoi(userId)
-	if err != nil {
-		http.Error(w, "Could not convert", http.StatusInternalServerError)
+	if msg := validateLength("Comments", postComment, commentMaxLength); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
 		return
 	}
 
+	// A reply names the comment it answers
+	var parentID sql.NullInt64
+	if parent := r.Form.Get("parent_id"); parent != "" {
+		comment, err := getCommentByID(parent)
+		if err == errCommentNotFound || (err == nil && comment.PostID != postIDStr) {
+			http.Error(w, errCommentNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Could not post comment", http.StatusInternalServerError)
+			return
+		}
+		depth, err := commentDepth(comment.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Could not post comment", http.StatusInternalServerError)
+			return
+		}
+		if depth >= MaxCommentDepth {
+			http.Error(w, "Replies cannot be nested any deeper", http.StatusBadRequest)
+			return
+		}
+		parentID = sql.NullInt64{Int64: int64(comment.ID), Valid: true}
+	}
+
+	dateCreated := time.Now()
+
 	// Use userID and postID to create a new comment
 	//user_ID gets excecuted to the database
-	_, err = DB.Exec("INSERT INTO comments (post_id, user_id, content, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
-		postID, userIdInt, postComment, dateCreated, dateCreated)
+	res, err := DB.Exec("INSERT INTO comments (post_id, user_id, parent_id, content, content_html, content_html_version, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		postID, userId, parentID, postComment, renderMarkdown(postComment), markdownVersion, dateCreated, dateCreated)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Could not post comment", http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Println("Comment successfully posted!")
+	commentID, _ := res.LastInsertId()
+	http.Redirect(w, r, fmt.Sprintf("/post/%s#comment-%d", postIDStr, commentID), http.StatusFound)
+}
 
-	http.Redirect(w, r, "/post/"+postIDStr, http.StatusFound)
+// commentDepth counts the replies above a comment, so top-level comments
+// are at depth 0
+func commentDepth(commentID int) (int, error) {
+	var n int
+	err := DB.QueryRow(`WITH RECURSIVE chain(id, parent_id) AS (
+			SELECT id, parent_id FROM comments WHERE id = ?
+			UNION ALL
+			SELECT c.id, c.parent_id FROM comments c JOIN chain ON c.id = chain.parent_id
+		)
+		SELECT COUNT(*) FROM chain`, commentID).Scan(&n)
+	return n - 1, err
 }
@@ -0,0 +1,123 @@
+package forum
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+)
+
+const (
+	// cookie holding the token for visitors who are not logged in
+	csrfCookieName = "csrf"
+	// form field and header a state-changing request carries the token in
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+
+	csrfContextKey contextKey = "csrf"
+)
+
+// csrfTokenForSession derives the CSRF token of a logged in session from the
+// session token. Only the session's owner can know it, and it does not need
+// to be stored next to the hashed session token.
+func csrfTokenForSession(sessionToken string) string {
+	mac := hmac.New(sha256.New, []byte(sessionToken))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CSRFToken returns the token to put in the request's forms
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey).(string)
+	return token
+}
+
+// safeMethod reports whether a request method cannot change state
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFProtect wraps every route. It works out the request's CSRF token,
+// makes it available to templates through CSRFToken, and rejects any
+// non-GET request that does not send it back in the csrf_token form field or
+// the X-CSRF-Token header.
+//
+// Logged in users get a token tied to their session. Everyone else gets a
+// random token in the csrf cookie, which protects the login and
+// registration forms too. A request whose session has ended is sent to the
+// login page rather than refused as forged.
+func CSRFProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		session, err := Sessions.Get(r)
+		// the cookie names a session that has expired or idled out
+		ended := err == ErrNoSession && hasSessionCookie(r)
+		if err == nil {
+			token = csrfTokenForSession(session.Token)
+		} else {
+			if err != ErrNoSession {
+				log.Println("Error checking session:", err)
+			}
+			if cookie, err := r.Cookie(csrfCookieName); err == nil && len(cookie.Value) >= tokenBytes {
+				token = cookie.Value
+			} else {
+				token, err = generateToken()
+				if err != nil {
+					log.Println(err)
+					http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+					return
+				}
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookieName,
+					Value:    token,
+					Path:     "/",
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+		}
+
+		if !safeMethod(r.Method) {
+			sent := r.Header.Get(csrfHeaderName)
+			if sent == "" {
+				sent = r.FormValue(csrfFieldName)
+			}
+			if sent == "" || !tokensEqual(sent, token) {
+				if ended {
+					// most likely a form from a tab left open too long
+					sessionEnded(w, r)
+					return
+				}
+				http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey, token)))
+	})
+}
+
+// hasSessionCookie reports whether the request names a session at all,
+// whether or not it is still valid
+func hasSessionCookie(r *http.Request) bool {
+	cookie, err := r.Cookie(sessionCookieName)
+	return err == nil && cookie.Value != ""
+}
+
+// sessionEnded answers a request made with a session that has expired or
+// idled out like RequireAuth does, instead of as a forged request. The dead
+// cookie is cleared so the login form gets the anonymous token.
+func sessionEnded(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	if wantsJSON(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
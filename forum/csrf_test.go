@@ -0,0 +1,136 @@
+package forum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// csrfRequest sends a POST through CSRFProtect to a handler that answers
+// 200, with the given token in the form and the given cookies
+func csrfRequest(target, token string, header map[string]string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	form := url.Values{}
+	if token != "" {
+		form.Set(csrfFieldName, token)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	CSRFProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(w, r)
+	return w
+}
+
+// anonymousCSRFCookie is what a GET gives a visitor who is not logged in
+func anonymousCSRFCookie(t *testing.T) *http.Cookie {
+	t.Helper()
+	w := httptest.NewRecorder()
+	CSRFProtect(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			return c
+		}
+	}
+	t.Fatal("no csrf cookie set")
+	return nil
+}
+
+// loginSession starts a session for a new user and returns its cookie
+func loginSession(t *testing.T) (*Session, *http.Cookie) {
+	t.Helper()
+	userID := createTestUser(t, "csrf@example.test", "csrfuser", "password1", true)
+	w := httptest.NewRecorder()
+	s, err := Sessions.Create(w, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, w.Result().Cookies()[0]
+}
+
+func TestCSRFAnonymous(t *testing.T) {
+	openTestDB(t)
+	cookie := anonymousCSRFCookie(t)
+
+	tests := []struct {
+		name    string
+		token   string
+		cookies []*http.Cookie
+		want    int
+	}{
+		{"no token", "", []*http.Cookie{cookie}, http.StatusForbidden},
+		{"no cookie", cookie.Value, nil, http.StatusForbidden},
+		{"wrong token", strings.Repeat("x", len(cookie.Value)), []*http.Cookie{cookie}, http.StatusForbidden},
+		{"cookie token", cookie.Value, []*http.Cookie{cookie}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := csrfRequest("/login", tt.token, nil, tt.cookies...); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCSRFSession(t *testing.T) {
+	openTestDB(t)
+	session, cookie := loginSession(t)
+	anon := anonymousCSRFCookie(t)
+	token := csrfTokenForSession(session.Token)
+
+	if w := csrfRequest("/create-post", token, nil, cookie); w.Code != http.StatusOK {
+		t.Errorf("session token: status %d", w.Code)
+	}
+	if w := csrfRequest("/create-post", "", map[string]string{csrfHeaderName: token}, cookie); w.Code != http.StatusOK {
+		t.Errorf("session token in the header: status %d", w.Code)
+	}
+	// once logged in the anonymous token no longer counts
+	if w := csrfRequest("/create-post", anon.Value, nil, cookie, anon); w.Code != http.StatusForbidden {
+		t.Errorf("anonymous token with a session: status %d", w.Code)
+	}
+	if w := csrfRequest("/create-post", "", nil, cookie); w.Code != http.StatusForbidden {
+		t.Errorf("no token with a session: status %d", w.Code)
+	}
+}
+
+func TestCSRFEndedSession(t *testing.T) {
+	openTestDB(t)
+	session, cookie := loginSession(t)
+	token := csrfTokenForSession(session.Token)
+	if _, err := DB.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", time.Now().Add(-2*Sessions.IdleTimeout), session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	w := csrfRequest("/create-post", token, nil, cookie)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/login" {
+		t.Errorf("browser: status %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		cleared = cleared || c.Name == sessionCookieName && c.MaxAge < 0
+	}
+	if !cleared {
+		t.Error("the ended session's cookie was not cleared")
+	}
+
+	if w := csrfRequest("/api/posts", token, nil, cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("API: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := csrfRequest("/create-post", token, map[string]string{"Accept": "application/json"}, cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("JSON: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// a stale cookie does not stop the anonymous token from working, so
+	// the login form can still be sent
+	anon := anonymousCSRFCookie(t)
+	if w := csrfRequest("/login", anon.Value, nil, cookie, anon); w.Code != http.StatusOK {
+		t.Errorf("login with a stale session cookie: status %d", w.Code)
+	}
+}
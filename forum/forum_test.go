@@ -0,0 +1,83 @@
+package forum
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	TemplateDir = filepath.Join("..", "templates")
+	if err := loadTemplates(); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// openTestDB points DB at a migrated copy of the repository database and
+// sets up the sessions and mailer the handlers use. Mail sent during the
+// test is kept in the returned MemoryMailer.
+func openTestDB(t *testing.T) *MemoryMailer {
+	t.Helper()
+	src, err := os.ReadFile(filepath.Join("..", "database.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "database.db")
+	if err := os.WriteFile(path, src, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", path+"?_txlock=immediate&_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	// tests run with and without -tags sqlite_fts5
+	UnrankedSearch = true
+	if err := initSearch(db); err != nil {
+		t.Fatal(err)
+	}
+
+	DB = db
+	Sessions = NewSessionManager(db)
+	mail := &MemoryMailer{}
+	Mail = mail
+	return mail
+}
+
+// createTestUser adds a user with the given password and returns its ID
+func createTestUser(t *testing.T, email, username, password string, verified bool) int {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := DB.Exec("INSERT INTO Users (Email, Username, Password, EmailVerified) VALUES (?, ?, ?, ?)", email, username, hash, verified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+// postForm calls a handler with a form POST and returns the response
+func postForm(h http.HandlerFunc, target string, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
@@ -1,151 +1,200 @@
 package forum
 
 import (
+	"errors"
+	"log"
 	"net/http"
-	"text/template"
-	"time"
+	"strconv"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func executePosts() ([]Post, error) {
-	var posts []Post //local struct - don't change as it duplicates the posts for some reason.
-	rows, err := DB.Query("SELECT id, title, content, created_at FROM posts")
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var post Post
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.Time)
-		if err != nil {
-			return nil, err
-		}
-		// Format the datetime string
-		t, err := time.Parse("2006-01-02T15:04:05.999999999-07:00", post.Time)
-		if err != nil {
-			return nil, err
-		}
-		post.Time = t.Format("January 2, 2006, 15:04:05")
-		// make post URLs
-		post.URL = "/post/" + post.ID
-		posts = append(posts, post)
-	}
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-	// reverse posts
-	posts = reverse(posts)
-	return posts, nil
-}
-
-// reverse posts (latest first)
-func reverse(s []Post) []Post {
-	//runes := []rune(s)
-	length := len(s)
-	for i, j := 0, length-1; i < j; i, j = i+1, j-1 {
-		s[i], s[j] = s[j], s[i]
-	}
-	return s
-}
-
 // serve homepage
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if the user is already logged in
-	existingSessionID, _ := r.Cookie("session")
-	isLoggedIn := existingSessionID != nil
+	user := CurrentUser(r)
 
-	posts, err := executePosts()
+	pg, err := parsePageRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := getFilteredPosts(PostFilter{}, pg)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Could not fetch posts", http.StatusInternalServerError)
 		return
 	}
 
 	data := HomePageData{
-		Posts:      posts,
-		IsLoggedIn: isLoggedIn, // Pass the IsLoggedIn information to the template
+		PageBase: newPageBase(r),
+		Posts:    page.Posts,
+		Links:    newPageLinks(r, pg, page),
+
+		NeedsVerification: user != nil && !user.EmailVerified,
 	}
+	renderTemplate(w, "home.html", data)
+}
 
-	tmpl, err := template.ParseFiles("home.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// handle filtered posts
+func FilteredPostsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parsePostFilter(r)
+	if err == errLoginRequired {
+		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	err = tmpl.Execute(w, data)
+	pg, err := parsePageRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-}
 
-// handle filtered posts
-func FilteredPostsHandler(w http.ResponseWriter, r *http.Request) {
-	category := r.URL.Query().Get("category")
-
-	// Retrieve the posts based on the selected category
-	filteredPosts, err := getPostsByCategory(category)
+	// Retrieve the posts matching the filter
+	page, err := getFilteredPosts(filter, pg)
 	if err != nil {
+		log.Println(err)
 		http.Error(w, "Could not fetch posts", http.StatusInternalServerError)
 		return
 	}
 
 	var data struct {
-		Category      string
-		FilteredPosts []Post // Use a slice of Post
+		PageBase
+		Filter PostFilter
+		Posts  []Post
+		Links  pageLinks
 	}
 
-	data.Category = category
-	data.FilteredPosts = filteredPosts
+	data.PageBase = newPageBase(r)
+	data.Filter = filter
+	data.Posts = page.Posts
+	data.Links = newPageLinks(r, pg, page)
 
-	tmpl, err := template.ParseFiles("filteredPosts.html")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Render the template with the filtered posts data
+	renderTemplate(w, "filteredPosts.html", data)
+}
+
+var errLoginRequired = errors.New("login required")
+
+// which posts to list; empty fields do not filter
+type PostFilter struct {
+	Categories []string // posts in any of these
+	Mine       bool     // written by UserID
+	Liked      bool     // liked by UserID
+	UserID     int
+}
+
+// HasCategory reports whether the filter includes the named category
+func (f PostFilter) HasCategory(name string) bool {
+	for _, c := range f.Categories {
+		if c == name {
+			return true
+		}
 	}
+	return false
+}
 
-	// Render the template with the filtered posts data
-	err = tmpl.ExecuteTemplate(w, "filteredPosts.html", data)
-	if err != nil {
-		http.Error(w, "Internal Server Error - homepage", http.StatusInternalServerError)
-		return
+// parsePostFilter reads the category, mine and liked query parameters.
+// mine and liked need a logged in user.
+func parsePostFilter(r *http.Request) (PostFilter, error) {
+	q := r.URL.Query()
+	f := PostFilter{
+		Mine:  q.Get("mine") == "1",
+		Liked: q.Get("liked") == "1",
+	}
+	for _, name := range q["category"] {
+		if name != "" {
+			f.Categories = append(f.Categories, name)
+		}
 	}
+	if f.Mine || f.Liked {
+		user := CurrentUser(r)
+		if user == nil {
+			return f, errLoginRequired
+		}
+		f.UserID = user.ID
+	}
+	return f, nil
 }
 
-// retrieve posts by their category
-func getPostsByCategory(category string) ([]Post, error) {
-	rows, err := DB.Query("SELECT id, title, content, created_at FROM posts WHERE category_id = ?", category)
+// retrieve one page of the posts matching every part of the filter
+func getFilteredPosts(f PostFilter, pg PageRequest) (*PostPage, error) {
+	query := "SELECT p.id, p.title, p.content, p.content_html, p.content_html_version, p.created_at, COALESCE(u.Username, ''), COALESCE(u.Karma, 0), " + pg.Sort.key(pg.Ref) +
+		" FROM posts p LEFT JOIN Users u ON u.ID = p.user_id WHERE p.deleted_at IS NULL"
+	var args []interface{}
+	if len(f.Categories) > 0 {
+		query += ` AND p.id IN (SELECT pc.post_id FROM post_categories pc
+			JOIN categories c ON c.id = pc.category_id
+			WHERE c.name IN (?` + strings.Repeat(", ?", len(f.Categories)-1) + `))`
+		for _, name := range f.Categories {
+			args = append(args, name)
+		}
+	}
+	if f.Mine {
+		query += " AND p.user_id = ?"
+		args = append(args, f.UserID)
+	}
+	if f.Liked {
+		query += " AND p.id IN (SELECT target_id FROM reactions WHERE target_type = 'post' AND kind = 'like' AND user_id = ?)"
+		args = append(args, f.UserID)
+	}
+	query, args = pageQuery(query, args, pg)
+	rows, err := DB.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var posts []Post
+	var caches []cachedHTML
+	var keys []cursor
 
 	for rows.Next() {
 		var post Post
-		err := rows.Scan(&post.ID, &post.Title, &post.Content, &post.Time)
-		if err != nil {
-			return nil, err
-		}
-
-		// Format the datetime string
-		t, err := time.Parse("2006-01-02T15:04:05.999999999-07:00", post.Time)
+		var c cursor
+		var cache cachedHTML
+		err := rows.Scan(&post.ID, &post.Title, &post.Content, &cache.HTML, &cache.Version, &post.Time, &post.Author, &post.AuthorKarma, &c.Key)
 		if err != nil {
 			return nil, err
 		}
-		post.Time = t.Format("January 2, 2006, 15:04:05")
+		c.ID, _ = strconv.Atoi(post.ID)
+		c.Ref = pg.Ref
+		keys = append(keys, c)
 
 		// make post URLs
 		post.URL = "/post/" + post.ID
 
 		posts = append(posts, post)
+		caches = append(caches, cache)
 	}
 
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
+	for i := range posts {
+		posts[i].ContentHTML = caches[i].render("posts", posts[i].ID, posts[i].Content)
+	}
+
+	// the extra row only shows there is more in the direction of travel
+	more := len(posts) > PostsPerPage
+	if more {
+		posts, keys = posts[:PostsPerPage], keys[:PostsPerPage]
+	}
+	if pg.Before != nil {
+		for i, j := 0, len(posts)-1; i < j; i, j = i+1, j-1 {
+			posts[i], posts[j] = posts[j], posts[i]
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
 
-	return posts, nil
+	page := &PostPage{Posts: posts}
+	if len(posts) > 0 {
+		if pg.After != nil || (pg.Before != nil && more) {
+			page.Prev = keys[0].String()
+		}
+		if pg.Before != nil || more {
+			page.Next = keys[len(keys)-1].String()
+		}
+	}
+	return page, nil
 }
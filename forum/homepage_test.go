@@ -0,0 +1,42 @@
+package forum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostFilterForm(t *testing.T) {
+	openTestDB(t)
+	userID := createTestUser(t, "filter@example.test", "filterer", "password1", true)
+
+	get := func(h http.HandlerFunc, target string) string {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: status %d", target, w.Code)
+		}
+		return w.Body.String()
+	}
+
+	// nothing is checked on the home page
+	body := get(asUser(t, userID, HomeHandler), "/")
+	if !strings.Contains(body, `name="mine"`) {
+		t.Error("home page has no filter form")
+	}
+	if strings.Contains(body, "checked") {
+		t.Error("home page filter has boxes checked")
+	}
+
+	// the filtered page checks what it filters by
+	body = get(asUser(t, userID, FilteredPostsHandler), "/filtered-posts?category=news&mine=1")
+	for _, want := range []string{`value="news" checked`, `name="mine" value="1" checked`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("filtered page does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, `name="liked" value="1" checked`) {
+		t.Error("liked is checked but was not filtered by")
+	}
+}
@@ -0,0 +1,95 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// points an author gets for each kind of reaction on their posts and
+// comments. Set with FORUM_KARMA_WEIGHTS, e.g. "like=1,love=3,dislike=-2".
+// Karma is adjusted as reactions come and go, so changing a weight only
+// affects reactions from then on.
+var KarmaWeights = map[string]int{
+	reactionLike:    1,
+	"love":          2,
+	"laugh":         1,
+	"wow":           1,
+	"sad":           0,
+	reactionDislike: -1,
+}
+
+// karma a user needs before they get a permission their role does not
+// give them. Only permissions in karmaPermissions can be earned. Set with
+// FORUM_KARMA_THRESHOLDS, e.g. "reaction.dislike=10,category.create=100".
+var KarmaThresholds = map[string]int{
+	PermCategoryCreate: 100,
+}
+
+// the permissions karma can unlock, with the permission that grants them
+// while no threshold is configured ("" for none). Disliking comes with
+// reacting at all until a threshold is set. Moderation stays with roles
+// however much karma someone collects.
+var karmaPermissions = map[string]string{
+	PermReactionDislike: PermReactionCreate,
+	PermCategoryCreate:  "",
+}
+
+func configureKarmaFromEnv() {
+	parseKarmaSetting("FORUM_KARMA_WEIGHTS", KarmaWeights)
+	parseKarmaSetting("FORUM_KARMA_THRESHOLDS", KarmaThresholds)
+	for perm := range KarmaThresholds {
+		if _, ok := karmaPermissions[perm]; !ok {
+			log.Printf("ignoring %s in FORUM_KARMA_THRESHOLDS, it cannot be earned with karma", perm)
+			delete(KarmaThresholds, perm)
+		}
+	}
+}
+
+// parseKarmaSetting reads comma-separated name=number pairs from an
+// environment variable into m, logging and skipping malformed entries
+func parseKarmaSetting(key string, m map[string]int) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	for _, pair := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			log.Printf("ignoring %q in %s", pair, key)
+			continue
+		}
+		m[name] = n
+	}
+}
+
+// karmaAllows reports whether a user has earned perm through karma, or
+// has it because no threshold is configured for it
+func karmaAllows(u *User, perm string) bool {
+	base, ok := karmaPermissions[perm]
+	if !ok {
+		return false
+	}
+	min, ok := KarmaThresholds[perm]
+	if !ok {
+		return base != "" && u.Role.Can(base)
+	}
+	return u.Karma >= min
+}
+
+// awardKarma credits the author of a reaction's target with the change
+// from the previous kind to the new one ("" for none). Reacting to your
+// own post or comment does not count.
+func awardKarma(tx *sql.Tx, table string, targetID, reactorID int, previous, kind string) error {
+	delta := KarmaWeights[kind] - KarmaWeights[previous]
+	if delta == 0 {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf(`UPDATE Users SET Karma = Karma + ?
+		WHERE ID = (SELECT user_id FROM %s WHERE id = ?) AND ID != ?`, table), delta, targetID, reactorID)
+	return err
+}
@@ -0,0 +1,150 @@
+package forum
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// withThresholds swaps KarmaThresholds for the length of a test
+func withThresholds(t *testing.T, thresholds map[string]int) {
+	saved := KarmaThresholds
+	KarmaThresholds = thresholds
+	t.Cleanup(func() { KarmaThresholds = saved })
+}
+
+func TestKarmaAllows(t *testing.T) {
+	user := &User{Role: RoleUser, Karma: 50}
+	tests := []struct {
+		name       string
+		thresholds map[string]int
+		perm       string
+		want       bool
+	}{
+		{"dislike without a threshold", map[string]int{}, PermReactionDislike, true},
+		{"dislike below the threshold", map[string]int{PermReactionDislike: 60}, PermReactionDislike, false},
+		{"dislike above the threshold", map[string]int{PermReactionDislike: 10}, PermReactionDislike, true},
+		{"category without a threshold", map[string]int{}, PermCategoryCreate, false},
+		{"category above the threshold", map[string]int{PermCategoryCreate: 50}, PermCategoryCreate, true},
+		{"moderation cannot be earned", map[string]int{PermUserBan: 0}, PermUserBan, false},
+		{"nor can roles be set", map[string]int{PermUserSetRole: 0}, PermUserSetRole, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withThresholds(t, tt.thresholds)
+			if got := user.Can(tt.perm); got != tt.want {
+				t.Errorf("Can(%s) = %v, want %v", tt.perm, got, tt.want)
+			}
+		})
+	}
+
+	withThresholds(t, map[string]int{})
+	if (&User{Role: RoleGuest}).Can(PermReactionDislike) {
+		t.Error("guests can dislike")
+	}
+}
+
+func TestKarmaThresholdsFromEnv(t *testing.T) {
+	withThresholds(t, map[string]int{})
+	t.Setenv("FORUM_KARMA_THRESHOLDS", "reaction.dislike=5,user.ban=1,user.role.set=1")
+	configureKarmaFromEnv()
+
+	if KarmaThresholds[PermReactionDislike] != 5 {
+		t.Errorf("reaction.dislike threshold = %d, want 5", KarmaThresholds[PermReactionDislike])
+	}
+	for _, perm := range []string{PermUserBan, PermUserSetRole} {
+		if _, ok := KarmaThresholds[perm]; ok {
+			t.Errorf("%s was accepted as a karma threshold", perm)
+		}
+	}
+}
+
+func TestRemoveDislikeBelowThreshold(t *testing.T) {
+	openTestDB(t)
+	withThresholds(t, map[string]int{})
+	authorID := createTestUser(t, "author@example.test", "author", "password1", true)
+	reactorID := createTestUser(t, "reactor@example.test", "reactor", "password1", true)
+	res, err := DB.Exec("INSERT INTO posts (user_id, title, content, created_at) VALUES (?, 'Title', 'Content', ?)", authorID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	postID := strconv.FormatInt(id, 10)
+
+	dislike := func() int {
+		w := postForm(asUser(t, reactorID, HandleLikesDislikes), "/post-like/"+postID, url.Values{"action": {reactionDislike}})
+		return w.Code
+	}
+	disliked := func() bool {
+		return countRows(t, "SELECT COUNT(*) FROM reactions WHERE user_id = ? AND target_type = 'post' AND target_id = ?", reactorID, id) == 1
+	}
+
+	if code := dislike(); code != http.StatusSeeOther || !disliked() {
+		t.Fatalf("dislike without a threshold: status %d", code)
+	}
+
+	// the threshold goes up after the dislike was given
+	KarmaThresholds[PermReactionDislike] = 10
+	if code := dislike(); code != http.StatusSeeOther || disliked() {
+		t.Fatalf("taking the dislike back: status %d, still there: %v", code, disliked())
+	}
+	if code := dislike(); code != http.StatusForbidden || disliked() {
+		t.Errorf("dislike below the threshold: status %d", code)
+	}
+}
+
+func TestReactionsReceivedMatchKarma(t *testing.T) {
+	openTestDB(t)
+	authorID := createTestUser(t, "author@example.test", "author", "password1", true)
+	reactorID := createTestUser(t, "reactor@example.test", "reactor", "password1", true)
+	res, err := DB.Exec("INSERT INTO posts (user_id, title, content, created_at) VALUES (?, 'Title', 'Content', ?)", authorID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	postID, _ := res.LastInsertId()
+	res, err = DB.Exec("INSERT INTO comments (post_id, user_id, content, created_at) VALUES (?, ?, 'Comment', ?)", postID, authorID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	commentID, _ := res.LastInsertId()
+
+	reactions := []struct {
+		userID     int
+		targetType string
+		targetID   int64
+		kind       string
+	}{
+		{reactorID, targetPost, postID, "love"},
+		{reactorID, targetComment, commentID, reactionLike},
+		// the author's own reactions earn nothing and are not received
+		{authorID, targetPost, postID, reactionLike},
+		{authorID, targetComment, commentID, "love"},
+	}
+	for _, r := range reactions {
+		if err := ToggleReaction(r.userID, r.targetType, int(r.targetID), r.kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received, _, err := reactionTotals(authorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total, fromReceived int
+	for _, rc := range received {
+		total += rc.Count
+		fromReceived += rc.Count * KarmaWeights[rc.Name]
+	}
+	if total != 2 {
+		t.Errorf("received %d reactions, want 2", total)
+	}
+	var karma int
+	if err := DB.QueryRow("SELECT Karma FROM Users WHERE ID = ?", authorID).Scan(&karma); err != nil {
+		t.Fatal(err)
+	}
+	if fromReceived != karma {
+		t.Errorf("reactions received are worth %d karma, but the author has %d", fromReceived, karma)
+	}
+}
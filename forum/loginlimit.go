@@ -0,0 +1,147 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// limits on password (and second factor) guessing. Attempts are kept in
+// login_attempts so they survive restarts.
+const (
+	// failures older than this are forgotten
+	loginAttemptWindow = 15 * time.Minute
+	// failed attempts in a row before an account is locked
+	maxLoginFailures = 5
+	// how long a locked account stays locked
+	loginLockout = 15 * time.Minute
+	// wait after the first failure; it doubles with every further failure
+	loginBackoffBase = 1 * time.Second
+	// failed attempts one IP address may make within the window, across all
+	// accounts
+	maxLoginFailuresPerIP = 20
+)
+
+// the same message for unknown emails and wrong passwords, so the login
+// form cannot be used to find out who has an account
+const invalidLoginMessage = "Invalid email or password."
+
+// compared against when the email is unknown so that the response takes as
+// long as for a real account
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+// clientIP is the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginRetryAfter returns how long the caller has to wait before another
+// login attempt for this email from this IP, or 0 if it may go ahead
+func loginRetryAfter(email, ip string, now time.Time) (time.Duration, error) {
+	since := now.Add(-loginAttemptWindow)
+
+	var ipFailures int
+	err := DB.QueryRow("SELECT COUNT(*) FROM login_attempts WHERE ip = ? AND success = 0 AND created_at > ?", ip, since).Scan(&ipFailures)
+	if err != nil {
+		return 0, err
+	}
+	if ipFailures >= maxLoginFailuresPerIP {
+		return loginAttemptWindow, nil
+	}
+
+	// failures in a row: those after the last successful login
+	var lastSuccess time.Time
+	err = DB.QueryRow("SELECT created_at FROM login_attempts WHERE email = ? AND success = 1 ORDER BY created_at DESC LIMIT 1", email).Scan(&lastSuccess)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil && lastSuccess.After(since) {
+		since = lastSuccess
+	}
+
+	rows, err := DB.Query("SELECT created_at FROM login_attempts WHERE email = ? AND success = 0 AND created_at > ? ORDER BY created_at DESC", email, since)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var failures int
+	var lastFailure time.Time
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return 0, err
+		}
+		if failures == 0 {
+			lastFailure = t
+		}
+		failures++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if failures == 0 {
+		return 0, nil
+	}
+
+	wait := loginBackoffBase << (failures - 1)
+	if failures >= maxLoginFailures {
+		wait = loginLockout
+	}
+	if until := lastFailure.Add(wait); until.After(now) {
+		return until.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// recordLoginAttempt stores the outcome of a login attempt. Emails that do
+// not belong to anyone are recorded too, so they lock the same way.
+func recordLoginAttempt(email, ip string, success bool) {
+	_, err := DB.Exec("INSERT INTO login_attempts (email, ip, success, created_at) VALUES (?, ?, ?, ?)", email, ip, success, time.Now())
+	if err != nil {
+		log.Println("Error recording login attempt:", err)
+	}
+}
+
+// tooManyLoginAttempts answers a blocked login attempt
+func tooManyLoginAttempts(w http.ResponseWriter, file string, data interface{}, wait time.Duration) {
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	renderTemplate(w, file, data)
+}
+
+func tooManyLoginAttemptsMessage(wait time.Duration) string {
+	if wait < time.Minute {
+		return "Too many failed login attempts. Please wait a few seconds and try again."
+	}
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %d minutes.", int(wait.Minutes())+1)
+}
+
+// cleanupLoginAttempts periodically deletes login attempts and password
+// reset requests nobody looks at anymore
+func cleanupLoginAttempts(interval time.Duration) {
+	for range time.Tick(interval) {
+		cutoff := time.Now().Add(-24 * time.Hour)
+		if _, err := DB.Exec("DELETE FROM login_attempts WHERE created_at < ?", cutoff); err != nil {
+			log.Println("Error deleting old login attempts:", err)
+		}
+		if _, err := DB.Exec("DELETE FROM password_reset_requests WHERE created_at < ?", cutoff); err != nil {
+			log.Println("Error deleting old password reset requests:", err)
+		}
+	}
+}
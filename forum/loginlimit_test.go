@@ -0,0 +1,78 @@
+package forum
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	type attempt struct {
+		email   string
+		ip      string
+		success bool
+		ago     time.Duration
+	}
+	// n failures for email from ip, the latest one `last` before now and
+	// the others a second apart before it
+	failures := func(email, ip string, n int, last time.Duration) []attempt {
+		var a []attempt
+		for i := n - 1; i >= 0; i-- {
+			a = append(a, attempt{email, ip, false, last + time.Duration(i)*time.Second})
+		}
+		return a
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+		want     time.Duration
+	}{
+		{"no attempts", nil, 0},
+		{"one failure", failures("a@example.test", "10.0.0.1", 1, 0), loginBackoffBase},
+		{"backoff doubles", failures("a@example.test", "10.0.0.1", 3, 0), 4 * loginBackoffBase},
+		{"backoff partly waited", failures("a@example.test", "10.0.0.1", 4, 3*time.Second), 5 * time.Second},
+		{"backoff over", failures("a@example.test", "10.0.0.1", 2, 10*time.Second), 0},
+		{"locked after max failures", failures("a@example.test", "10.0.0.1", maxLoginFailures, 0), loginLockout},
+		{"lockout partly waited", failures("a@example.test", "10.0.0.1", maxLoginFailures, 5*time.Minute), loginLockout - 5*time.Minute},
+		{"failures outside the window", failures("a@example.test", "10.0.0.1", maxLoginFailures, loginAttemptWindow+time.Minute), 0},
+		{"other emails do not count", failures("b@example.test", "10.0.0.1", maxLoginFailures, 0), 0},
+		{"ip cap across emails", func() []attempt {
+			var a []attempt
+			for i := 0; i < maxLoginFailuresPerIP; i++ {
+				a = append(a, attempt{"other@example.test", "10.0.0.1", false, time.Duration(i) * time.Minute / 2})
+			}
+			return a
+		}(), loginAttemptWindow},
+		{"ip cap only counts that ip", failures("b@example.test", "10.0.0.2", maxLoginFailuresPerIP, time.Minute), 0},
+		{"success resets the count", append(
+			failures("a@example.test", "10.0.0.1", maxLoginFailures, 2*time.Minute),
+			attempt{"a@example.test", "10.0.0.1", true, time.Minute},
+		), 0},
+		{"failures after a success", append(append(
+			failures("a@example.test", "10.0.0.1", maxLoginFailures, 2*time.Minute),
+			attempt{"a@example.test", "10.0.0.1", true, time.Minute}),
+			failures("a@example.test", "10.0.0.1", 2, 0)...,
+		), 2 * loginBackoffBase},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			for _, a := range tt.attempts {
+				_, err := DB.Exec("INSERT INTO login_attempts (email, ip, success, created_at) VALUES (?, ?, ?, ?)", a.email, a.ip, a.success, now.Add(-a.ago))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := loginRetryAfter("a@example.test", "10.0.0.1", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("loginRetryAfter = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package forum
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// an outgoing email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email. Mail is the one used by the handlers.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var Mail Mailer
+
+// SMTPMailer delivers mail through an SMTP server. Point Addr at a local
+// sink such as MailHog (localhost:1025) during development.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // nil for servers without authentication
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, formatMessage(m.From, msg))
+}
+
+// FileMailer writes every message to its own file in Dir instead of
+// sending it, so mail can be read offline
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000000"), sanitizeFileName(msg.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMessage(m.From, msg), 0o600)
+}
+
+// MemoryMailer keeps sent messages in memory
+type MemoryMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *MemoryMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns a copy of everything sent so far
+func (m *MemoryMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// newMailerFromEnv uses SMTP when FORUM_SMTP_ADDR is set and writes mail to
+// FORUM_MAIL_DIR (default ./mail) otherwise
+func newMailerFromEnv() Mailer {
+	from := envOr("FORUM_MAIL_FROM", "forum@localhost")
+	addr := os.Getenv("FORUM_SMTP_ADDR")
+	if addr == "" {
+		return &FileMailer{Dir: envOr("FORUM_MAIL_DIR", "mail"), From: from}
+	}
+
+	m := &SMTPMailer{Addr: addr, From: from}
+	if user := os.Getenv("FORUM_SMTP_USER"); user != "" {
+		host := strings.Split(addr, ":")[0]
+		m.Auth = smtp.PlainAuth("", user, os.Getenv("FORUM_SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// strips line breaks so header values cannot add headers of their own
+var headerReplacer = strings.NewReplacer("\r", "", "\n", "")
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", headerReplacer.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerReplacer.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerReplacer.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '@' || r == '.' || r == '-' || r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,578 @@
+package forum
+
+import (
+	"database/sql"
+	"html"
+	"html/template"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Posts and comments are written in Markdown. The source is kept for
+// editing and the rendered HTML is cached next to it. The renderer escapes
+// all text, including any raw HTML, and its output still goes through
+// sanitizeHTML so only allowlisted tags and attributes reach a page.
+
+// markdownVersion is stored with every cached rendering. Bump it whenever
+// the renderer or the allowlist changes so old HTML is rendered again.
+const markdownVersion = 3
+
+// quotes and lists nested deeper than this are rendered as plain text, so
+// a line of a thousand '>' does not render a thousand copies of itself
+const maxBlockDepth = 16
+
+var (
+	headingRe  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	fenceRe    = regexp.MustCompile("^ {0,3}(```+|~~~+)[ \t]*([^`\\s]*)")
+	ruleRe     = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	quoteRe    = regexp.MustCompile(`^ {0,3}> ?`)
+	listItemRe = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])(?:[ \t]+|$)`)
+	autolinkRe = regexp.MustCompile(`^<((?:https?|mailto):[^\s<>]+)>`)
+	bareURLRe  = regexp.MustCompile(`^https?://[^\s<]+`)
+)
+
+// renderMarkdown turns Markdown source into sanitized HTML
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	src = strings.ReplaceAll(src, "\t", "    ")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), false, 0)
+	return sanitizeHTML(b.String())
+}
+
+// renderBlocks writes headings, code blocks, quotes, lists, rules and
+// paragraphs. Paragraphs in tight list items are written without <p>.
+// depth counts the quotes and lists the lines are inside.
+func renderBlocks(b *strings.Builder, lines []string, tight bool, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case fenceRe.MatchString(line):
+			i = renderFence(b, lines, i)
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			tag := "h" + strconv.Itoa(len(m[1]))
+			b.WriteString("<" + tag + ">" + renderInline(m[2], false) + "</" + tag + ">\n")
+			i++
+		case ruleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+		case depth < maxBlockDepth && quoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteRe.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, false, depth+1)
+			b.WriteString("</blockquote>\n")
+		case depth < maxBlockDepth && listItemRe.MatchString(line):
+			i = renderList(b, lines, i, depth)
+		case strings.HasPrefix(line, "    "):
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "\n</code></pre>\n")
+		default:
+			para := []string{strings.TrimLeft(line, " ")}
+			for i++; i < len(lines) && !interruptsParagraph(lines[i]); i++ {
+				para = append(para, strings.TrimLeft(lines[i], " "))
+			}
+			text := renderInline(strings.Join(para, "\n"), false)
+			if tight {
+				b.WriteString(text + "\n")
+			} else {
+				b.WriteString("<p>" + text + "</p>\n")
+			}
+		}
+	}
+}
+
+// interruptsParagraph reports whether line ends the paragraph before it.
+// Only lists starting at 1 do, so a sentence that begins with a year does not.
+func interruptsParagraph(line string) bool {
+	if strings.TrimSpace(line) == "" || fenceRe.MatchString(line) || headingRe.MatchString(line) ||
+		ruleRe.MatchString(line) || quoteRe.MatchString(line) {
+		return true
+	}
+	m := listItemRe.FindStringSubmatch(line)
+	return m != nil && (!isOrderedMarker(m[2]) || strings.TrimLeft(m[2], "0") == "1.")
+}
+
+// renderFence writes the fenced code block starting at lines[i] and returns
+// the index of the line after it. An unclosed fence runs to the end.
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	m := fenceRe.FindStringSubmatch(lines[i])
+	fence := m[1]
+	var code []string
+	for i++; i < len(lines); i++ {
+		if trimmed := strings.TrimSpace(lines[i]); strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			i++
+			break
+		}
+		code = append(code, lines[i])
+	}
+
+	b.WriteString("<pre><code")
+	if m[2] != "" {
+		b.WriteString(` class="language-` + html.EscapeString(m[2]) + `"`)
+	}
+	b.WriteString(">")
+	if len(code) > 0 {
+		b.WriteString(html.EscapeString(strings.Join(code, "\n")) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+	return i
+}
+
+func isOrderedMarker(marker string) bool {
+	return marker[0] >= '0' && marker[0] <= '9'
+}
+
+// renderList writes the list starting at lines[i] and returns the index of
+// the line after it. Lines indented to an item's text belong to that item.
+// A list with blank lines between or inside its items is loose and wraps
+// each item's paragraphs in <p>.
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+	first := listItemRe.FindStringSubmatch(lines[i])
+	ordered := isOrderedMarker(first[2])
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		if !sameListType(lines[i], ordered) {
+			break
+		}
+		m := listItemRe.FindStringSubmatchIndex(lines[i])
+		indent := m[1]
+		if indent == len(lines[i]) {
+			indent = m[5] + 1 // an empty item's text starts after the marker
+		}
+		item := []string{lines[i][m[1]:]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				next := i + 1
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next < len(lines) && leadingSpaces(lines[next]) >= indent {
+					item = append(item, "")
+					loose = true
+					continue
+				}
+				break
+			}
+			if leadingSpaces(line) >= indent {
+				item = append(item, line[indent:])
+				continue
+			}
+			if listItemRe.MatchString(line) || interruptsParagraph(line) {
+				break
+			}
+			// a lazy continuation of the item's last paragraph
+			item = append(item, strings.TrimSpace(line))
+		}
+		items = append(items, item)
+
+		// skip the blank lines before the next item
+		next := i
+		for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next == i {
+			continue
+		}
+		if next < len(lines) && sameListType(lines[next], ordered) {
+			loose = true
+			i = next
+			continue
+		}
+		break
+	}
+
+	if ordered {
+		start, _ := strconv.Atoi(strings.TrimRight(first[2], ".)"))
+		if start != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(start) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		renderBlocks(b, item, !loose, depth+1)
+		b.WriteString("</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// sameListType reports whether line starts an item of an ordered or
+// unordered list
+func sameListType(line string, ordered bool) bool {
+	m := listItemRe.FindStringSubmatch(line)
+	return m != nil && isOrderedMarker(m[2]) == ordered
+}
+
+func leadingSpaces(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// renderInline handles code spans, emphasis, links and line breaks within a
+// block. Link text is rendered with noLinks set so links never nest.
+func renderInline(s string, noLinks bool) string {
+	var b strings.Builder
+	closers := closerCache{}
+	var links *linkIndex
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!<>|~", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+		case c == '`':
+			n := runLength(s[i:], '`')
+			end := closers.find(s, i+n, "`", n)
+			if end < 0 {
+				b.WriteString(s[i : i+n])
+				i += n
+				break
+			}
+			code := strings.ReplaceAll(s[i+n:end], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+			i = end + n
+		case c == '*' || c == '_':
+			n := runLength(s[i:], c)
+			if n > 3 || i+n == len(s) || s[i+n] == ' ' || s[i+n] == '\n' || c == '_' && i > 0 && isWordByte(s[i-1]) {
+				b.WriteString(s[i : i+n])
+				i += n
+				break
+			}
+			end := closers.find(s, i+n, string(c), n)
+			if end < 0 || c == '_' && end+n < len(s) && isWordByte(s[end+n]) {
+				b.WriteString(s[i : i+n])
+				i += n
+				break
+			}
+			inner := renderInline(s[i+n:end], noLinks)
+			switch n {
+			case 1:
+				b.WriteString("<em>" + inner + "</em>")
+			case 2:
+				b.WriteString("<strong>" + inner + "</strong>")
+			default:
+				b.WriteString("<strong><em>" + inner + "</em></strong>")
+			}
+			i = end + n
+		case c == '[' && !noLinks:
+			if links == nil {
+				links = newLinkIndex(s)
+			}
+			text, href, n := links.parse(s, i)
+			if n == 0 {
+				b.WriteByte(c)
+				i++
+				break
+			}
+			b.WriteString(`<a href="` + html.EscapeString(href) + `">` + renderInline(text, true) + "</a>")
+			i += n
+		case c == '<' && !noLinks && autolinkRe.MatchString(s[i:]):
+			m := autolinkRe.FindStringSubmatch(s[i:])
+			b.WriteString(`<a href="` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+			i += len(m[0])
+		case c == 'h' && !noLinks && (i == 0 || !isWordByte(s[i-1])) && bareURLRe.MatchString(s[i:]):
+			link := strings.TrimRight(bareURLRe.FindString(s[i:]), ".,:;!?'\")")
+			b.WriteString(`<a href="` + html.EscapeString(link) + `">` + html.EscapeString(link) + "</a>")
+			i += len(link)
+		case c == ' ' && runLength(s[i:], ' ') >= 2 && strings.HasPrefix(strings.TrimLeft(s[i:], " "), "\n"):
+			// two or more spaces at the end of a line
+			b.WriteString("<br>")
+			i += runLength(s[i:], ' ')
+		default:
+			b.WriteString(html.EscapeString(s[i : i+1]))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// linkIndex holds the ']' matching each '[' and the next ')' after each
+// position in a piece of inline text. Both are found in one pass, so text
+// full of brackets does not send every '[' to the end of it.
+type linkIndex struct {
+	closeBracket map[int]int
+	nextParen    []int
+}
+
+func newLinkIndex(s string) *linkIndex {
+	idx := &linkIndex{closeBracket: map[int]int{}, nextParen: make([]int, len(s)+1)}
+	var open []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			open = append(open, i)
+		case ']':
+			if len(open) > 0 {
+				idx.closeBracket[open[len(open)-1]] = i
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	idx.nextParen[len(s)] = -1
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] == ')' {
+			idx.nextParen[i] = i
+		} else {
+			idx.nextParen[i] = idx.nextParen[i+1]
+		}
+	}
+	return idx
+}
+
+// parse reads a [text](url) link starting at s[i] and returns its parts
+// and length, or a zero length if no safe link starts there
+func (idx *linkIndex) parse(s string, i int) (text, href string, n int) {
+	end, ok := idx.closeBracket[i]
+	if !ok || end+1 >= len(s) || s[end+1] != '(' {
+		return "", "", 0
+	}
+	close := idx.nextParen[end+2]
+	if close < 0 {
+		return "", "", 0
+	}
+	href = strings.TrimSpace(s[end+2 : close])
+	href = strings.TrimSuffix(strings.TrimPrefix(href, "<"), ">")
+	if href == "" || strings.ContainsAny(href, " \n") || !safeURL(href) {
+		return "", "", 0
+	}
+	return s[i+1 : end], href, close + 1 - i
+}
+
+// runLength counts how many times c repeats at the start of s
+func runLength(s string, c byte) int {
+	n := 0
+	for n < len(s) && s[n] == c {
+		n++
+	}
+	return n
+}
+
+// closerCache remembers the last closingRun result for each delimiter and
+// run length within one piece of inline text. Openers are met in order, so
+// a run that found no partner never will, and a partner found past the new
+// starting point is still the first one. Without this every unmatched '*'
+// would search to the end of the text.
+type closerCache map[closerKey]int
+
+type closerKey struct {
+	delim byte
+	n     int
+}
+
+func (c closerCache) find(s string, from int, delim string, n int) int {
+	key := closerKey{delim[0], n}
+	if end, ok := c[key]; ok && (end < 0 || end > from) {
+		return end
+	}
+	end := closingRun(s, from, delim, n)
+	c[key] = end
+	return end
+}
+
+// closingRun finds a run of exactly n delimiters at or after from that can
+// close a span, or returns -1. Emphasis cannot close after a space.
+func closingRun(s string, from int, delim string, n int) int {
+	for i := from; i < len(s); {
+		j := strings.Index(s[i:], delim)
+		if j < 0 {
+			return -1
+		}
+		j += i
+		run := runLength(s[j:], delim[0])
+		if run == n && (delim == "`" || j > from && s[j-1] != ' ' && s[j-1] != '\n') {
+			return j
+		}
+		i = j + run
+	}
+	return -1
+}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// safeURL allows web and mail links and relative links within the forum.
+// Browsers read a backslash in a link as a slash and skip leading spaces,
+// so "/\evil.com" or " //evil.com" would lead to another site.
+func safeURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	case "":
+		return raw == strings.TrimSpace(raw) && !strings.HasPrefix(raw, "//") && !strings.ContainsRune(raw, '\\')
+	}
+	return false
+}
+
+// tags sanitizeHTML keeps, with the attributes each may have
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"blockquote": nil, "pre": nil, "code": {"class"},
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"em": nil, "strong": nil, "a": {"href"},
+}
+
+// tags that have no closing tag
+var voidTags = map[string]bool{"br": true, "hr": true}
+
+var (
+	tagRe         = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)((?:\s+[a-zA-Z][a-zA-Z0-9-]*(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*)\s*/?>`)
+	attrRe        = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9-]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	entityRe      = regexp.MustCompile(`^&(?:[a-zA-Z][a-zA-Z0-9]{1,31}|#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6});`)
+	codeClassRe   = regexp.MustCompile(`^language-[a-zA-Z0-9_+-]+$`)
+	listStartRe   = regexp.MustCompile(`^[0-9]{1,9}$`)
+	attrValueOKRe = map[string]func(string) bool{
+		"href":  safeURL,
+		"class": codeClassRe.MatchString,
+		"start": listStartRe.MatchString,
+	}
+)
+
+// sanitizeHTML keeps only the tags and attributes in allowedTags and
+// escapes everything else. Unsafe link targets are dropped, every link gets
+// rel="nofollow ugc", and tags left open are closed at the end.
+func sanitizeHTML(s string) string {
+	var b strings.Builder
+	var open []string
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "<>&\"'")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		switch s[0] {
+		case '<':
+			if m := tagRe.FindStringSubmatch(s); m != nil {
+				writeTag(&b, &open, m[1] == "/", strings.ToLower(m[2]), m[3])
+				s = s[len(m[0]):]
+				continue
+			}
+			b.WriteString("&lt;")
+		case '&':
+			if entity := entityRe.FindString(s); entity != "" {
+				b.WriteString(entity)
+				s = s[len(entity):]
+				continue
+			}
+			b.WriteString("&amp;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&#34;")
+		case '\'':
+			b.WriteString("&#39;")
+		}
+		s = s[1:]
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+// writeTag writes an allowed tag with its allowed attributes. Closing tags
+// that were never opened are dropped; ones that skip over open tags close
+// those first.
+func writeTag(b *strings.Builder, open *[]string, closing bool, name, attrs string) {
+	allowed, ok := allowedTags[name]
+	if !ok {
+		return
+	}
+
+	if closing {
+		for i := len(*open) - 1; i >= 0; i-- {
+			if (*open)[i] != name {
+				continue
+			}
+			for j := len(*open) - 1; j >= i; j-- {
+				b.WriteString("</" + (*open)[j] + ">")
+			}
+			*open = (*open)[:i]
+			return
+		}
+		return
+	}
+
+	b.WriteString("<" + name)
+	seen := map[string]bool{}
+	for _, m := range attrRe.FindAllStringSubmatch(attrs, -1) {
+		attr := strings.ToLower(m[1])
+		value := html.UnescapeString(m[2] + m[3] + m[4])
+		for _, a := range allowed {
+			if a == attr && !seen[attr] && attrValueOKRe[attr](value) {
+				b.WriteString(" " + attr + `="` + html.EscapeString(value) + `"`)
+				seen[attr] = true
+			}
+		}
+	}
+	if name == "a" {
+		b.WriteString(` rel="nofollow ugc"`)
+	}
+	b.WriteString(">")
+	if !voidTags[name] {
+		*open = append(*open, name)
+	}
+}
+
+// cachedHTML is a row's content_html and content_html_version as read from
+// the database
+type cachedHTML struct {
+	HTML    sql.NullString
+	Version int
+}
+
+// render returns the cached HTML, or renders content again and saves it if
+// the cache is missing or was made by an older renderer. table is posts or
+// comments. Call it after the rows it was read from are closed.
+func (c cachedHTML) render(table string, id interface{}, content string) template.HTML {
+	if c.HTML.Valid && c.Version == markdownVersion {
+		return template.HTML(c.HTML.String)
+	}
+	rendered := renderMarkdown(content)
+	_, err := DB.Exec("UPDATE "+table+" SET content_html = ?, content_html_version = ? WHERE id = ?", rendered, markdownVersion, id)
+	if err != nil {
+		log.Println("Error caching rendered content:", err)
+	}
+	return template.HTML(rendered)
+}
@@ -0,0 +1,152 @@
+package forum
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/a?b=c", true},
+		{"http://example.com", true},
+		{"mailto:someone@example.com", true},
+		{"/post/1", true},
+		{"post/1#comment-2", true},
+		{"?page=2", true},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"vbscript:msgbox(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"file:///etc/passwd", false},
+		{"//evil.com", false},
+		{`/\evil.com`, false},
+		{`\\evil.com`, false},
+		{`\/evil.com`, false},
+		{`/post\1`, false},
+		{" //evil.com", false},
+		{"/\t/evil.com", false},
+		{"java\nscript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.url); got != tt.want {
+			t.Errorf("safeURL(%q) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"paragraph", "hello\nworld", "<p>hello\nworld</p>\n"},
+		{"emphasis", "*a* _b_ **c** ***d***", "<p><em>a</em> <em>b</em> <strong>c</strong> <strong><em>d</em></strong></p>\n"},
+		{"no emphasis inside words", "snake_case_name", "<p>snake_case_name</p>\n"},
+		{"unclosed emphasis", "*a", "<p>*a</p>\n"},
+		{"code span", "`<b>` and `a*b*`", "<p><code>&lt;b&gt;</code> and <code>a*b*</code></p>\n"},
+		{"heading", "## Title ##", "<h2>Title</h2>\n"},
+		{"link", "[site](https://example.com)", `<p><a href="https://example.com" rel="nofollow ugc">site</a></p>` + "\n"},
+		{"relative link", "[post](/post/1)", `<p><a href="/post/1" rel="nofollow ugc">post</a></p>` + "\n"},
+		{"javascript link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>\n"},
+		{"protocol relative link", "[x](//evil.com)", "<p>[x](//evil.com)</p>\n"},
+		{"backslash link", `[x](/\evil.com)`, `<p>[x](/\evil.com)</p>` + "\n"},
+		{"double backslash link", `[x](\\evil.com)`, `<p>[x](\evil.com)</p>` + "\n"},
+		{"attribute injection", `[x](https://example.com/"onmouseover="alert(1))`,
+			`<p><a href="https://example.com/&#34;onmouseover=&#34;alert(1" rel="nofollow ugc">x</a>)</p>` + "\n"},
+		{"autolink", "<https://example.com>", `<p><a href="https://example.com" rel="nofollow ugc">https://example.com</a></p>` + "\n"},
+		{"bare url", "see https://example.com.", `<p>see <a href="https://example.com" rel="nofollow ugc">https://example.com</a>.</p>` + "\n"},
+		{"raw html", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"raw tag with attributes", `<img src=x onerror="alert(1)">`, "<p>&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>\n"},
+		{"tight list", "- a\n- b", "<ul>\n<li>a\n</li>\n<li>b\n</li>\n</ul>\n"},
+		{"loose list", "- a\n\n- b", "<ul>\n<li><p>a</p>\n</li>\n<li><p>b</p>\n</li>\n</ul>\n"},
+		{"ordered list", "3. a\n4. b", "<ol start=\"3\">\n<li>a\n</li>\n<li>b\n</li>\n</ol>\n"},
+		{"year is not a list", "It was\n1999. Then", "<p>It was\n1999. Then</p>\n"},
+		{"fence", "```go\nif a < b {}\n```", "<pre><code class=\"language-go\">if a &lt; b {}\n</code></pre>\n"},
+		{"unclosed fence", "```\n<b>", "<pre><code>&lt;b&gt;\n</code></pre>\n"},
+		{"fence language injection", "```\"onclick=\"x\nx\n```", "<pre><code>x\n</code></pre>\n"},
+		{"quote", "> *quoted*", "<blockquote>\n<p><em>quoted</em></p>\n</blockquote>\n"},
+		{"escape", `\*not emphasis\*`, "<p>*not emphasis*</p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.src); got != tt.want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name, html, want string
+	}{
+		{"allowed tags", "<p><em>a</em></p>", "<p><em>a</em></p>"},
+		{"tag names are case-insensitive", "<P>a</P>", "<p>a</p>"},
+		{"unknown tags dropped", "<script>alert(1)</script>", "alert(1)"},
+		{"unknown attributes dropped", `<p onclick="alert(1)" style="x">a</p>`, "<p>a</p>"},
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+		{"entity encoded javascript href", `<a href="&#106;avascript:alert(1)">x</a>`, `<a rel="nofollow ugc">x</a>`},
+		{"backslash href", `<a href="/\evil.com">x</a>`, `<a rel="nofollow ugc">x</a>`},
+		{"safe href", `<a href='https://example.com/?a=1&amp;b=2'>x</a>`, `<a href="https://example.com/?a=1&amp;b=2" rel="nofollow ugc">x</a>`},
+		{"rel cannot be set", `<a href="/" rel="opener">x</a>`, `<a href="/" rel="nofollow ugc">x</a>`},
+		{"duplicate attribute", `<a href="/a" href="javascript:alert(1)">x</a>`, `<a href="/a" rel="nofollow ugc">x</a>`},
+		{"unquoted attribute", `<ol start=3>`, `<ol start="3"></ol>`},
+		{"bad list start", `<ol start="1;x">`, `<ol></ol>`},
+		{"bad code class", `<code class="x y">a</code>`, `<code>a</code>`},
+		{"unclosed tags closed", "<blockquote><p><strong>a", "<blockquote><p><strong>a</strong></p></blockquote>"},
+		{"stray closing tag", "a</p></strong>", "a"},
+		{"misnested tags", "<strong><em>a</strong>b</em>", "<strong><em>a</em></strong>b"},
+		{"broken tag escaped", `<a href="x>y`, `&lt;a href=&#34;x&gt;y`},
+		{"quotes escaped", `"'`, "&#34;&#39;"},
+		{"entities kept", "&amp; &lt; &#39; &#x27;", "&amp; &lt; &#39; &#x27;"},
+		{"bare ampersand", "a & b", "a &amp; b"},
+		{"void tags", "a<br/>b<hr>", "a<br>b<hr>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeHTML(tt.html); got != tt.want {
+				t.Errorf("sanitizeHTML(%q)\n got %q\nwant %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
+
+// Text full of unmatched delimiters used to take quadratic time, letting
+// one post tie up the server for seconds
+func TestRenderMarkdownAdversarial(t *testing.T) {
+	inputs := map[string]string{
+		"emphasis":        "*a ",
+		"underscores":     "_a ",
+		"strong":          "**a _b **c __d ***e ",
+		"code spans":      "``a `",
+		"brackets":        "[",
+		"unclosed links":  "[a](",
+		"nested quotes":   ">",
+		"spaced quotes":   "> ",
+		"nested lists":    "- ",
+		"ordered lists":   "1. ",
+		"autolinks":       "<http:a",
+		"mixed":           "**a _b `c [d](",
+		"trailing spaces": "a  ",
+	}
+	for name, unit := range inputs {
+		t.Run(name, func(t *testing.T) {
+			src := strings.Repeat(unit, postMaxLength/len(unit))
+			start := time.Now()
+			renderMarkdown(src)
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("rendering %d bytes took %v", len(src), d)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownDepthLimit(t *testing.T) {
+	got := renderMarkdown(strings.Repeat(">", maxBlockDepth+5) + " deep")
+	if n := strings.Count(got, "<blockquote>"); n != maxBlockDepth {
+		t.Errorf("%d nested quotes rendered, want %d", n, maxBlockDepth)
+	}
+}
@@ -0,0 +1,114 @@
+package forum
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// getUserByID loads a user row
+func getUserByID(id int) (*User, error) {
+	var u User
+	err := DB.QueryRow("SELECT ID, Email, Username, EmailVerified, Role, Banned, Karma FROM Users WHERE ID = ?", id).
+		Scan(&u.ID, &u.Email, &u.Username, &u.EmailVerified, &u.Role, &u.Banned, &u.Karma)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// authenticate validates the request's session against the database and
+// returns the user it belongs to
+func authenticate(r *http.Request) (*User, error) {
+	userID, err := Sessions.UserID(r)
+	if err != nil {
+		return nil, err
+	}
+	user, err := getUserByID(userID)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSession
+	}
+	if err != nil {
+		return nil, err
+	}
+	// banned users are logged out wherever they are
+	if user.Banned {
+		return nil, ErrNoSession
+	}
+	return user, nil
+}
+
+// CurrentUser returns the user placed in the request context by RequireAuth
+// or WithUser, or nil for anonymous requests
+func CurrentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+func withUserContext(r *http.Request, user *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// wantsJSON reports whether the request came from an API client rather
+// than a browser page
+func wantsJSON(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// RequireAuth only lets requests with a valid session through. Browsers are
+// redirected to the login page, API clients get a 401.
+func RequireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(r)
+		if err != nil {
+			if err != ErrNoSession {
+				log.Println("Error checking session:", err)
+			}
+			if wantsJSON(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			} else {
+				http.Redirect(w, r, "/login", http.StatusFound)
+			}
+			return
+		}
+		next(w, withUserContext(r, user))
+	}
+}
+
+// WithUser adds the logged in user to the request context when there is
+// one, but lets anonymous requests through too
+func WithUser(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticate(r)
+		if err == nil {
+			r = withUserContext(r, user)
+		} else if err != ErrNoSession {
+			log.Println("Error checking session:", err)
+		}
+		next(w, r)
+	}
+}
+
+// RequireVerified stops users who have not confirmed their email address
+// when RequireVerifiedEmail is switched on. It must run inside RequireAuth.
+func RequireVerified(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := CurrentUser(r)
+		if RequireVerifiedEmail && !user.EmailVerified {
+			if wantsJSON(r) {
+				http.Error(w, "Email address not verified", http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusForbidden)
+			renderTemplate(w, "verifyEmail.html", verifyEmailData{PageBase: newPageBase(r), NeedsVerification: true})
+			return
+		}
+		next(w, r)
+	}
+}
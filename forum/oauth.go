@@ -0,0 +1,496 @@
+package forum
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// name of the cookie that ties an OAuth callback to the browser that
+// started the login
+const oauthStateCookieName = "oauth_state"
+
+var errNoVerifiedEmail = errors.New("the provider did not return a verified email address")
+
+// an OAuth2 identity provider using the authorization code flow
+type OAuthProvider struct {
+	Name         string // used in URLs, e.g. "github"
+	Title        string // shown on buttons, e.g. "GitHub"
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	// EmailsURL lists the user's addresses with their verified flag (GitHub)
+	EmailsURL string
+	Scopes    []string
+	// fetchProfile reads the signed in user from the provider's API
+	fetchProfile func(p *OAuthProvider, accessToken string) (*oauthProfile, error)
+}
+
+// the parts of an external account the forum cares about
+type oauthProfile struct {
+	Subject       string // the provider's stable user ID
+	Login         string // suggested username
+	Email         string
+	EmailVerified bool
+}
+
+// OAuthProviders holds the configured providers by name. Tests can add a
+// provider pointing at a fake server with RegisterOAuthProvider.
+var OAuthProviders = map[string]*OAuthProvider{}
+
+// OAuthClient is used for every request to a provider
+var OAuthClient = &http.Client{Timeout: 10 * time.Second}
+
+func RegisterOAuthProvider(p *OAuthProvider) {
+	OAuthProviders[p.Name] = p
+}
+
+// oauthProviderList returns the configured providers in a stable order for
+// the login and register pages
+func oauthProviderList() []*OAuthProvider {
+	list := make([]*OAuthProvider, 0, len(OAuthProviders))
+	for _, p := range OAuthProviders {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// configureOAuthFromEnv registers GitHub and Google when their client IDs are
+// set (FORUM_GITHUB_CLIENT_ID, FORUM_GOOGLE_CLIENT_ID, ...). Every endpoint
+// can be overridden, e.g. FORUM_GITHUB_TOKEN_URL, to use a local fake server.
+func configureOAuthFromEnv() {
+	defaults := []*OAuthProvider{
+		{
+			Name:         "github",
+			Title:        "GitHub",
+			AuthURL:      "https://github.com/login/oauth/authorize",
+			TokenURL:     "https://github.com/login/oauth/access_token",
+			UserInfoURL:  "https://api.github.com/user",
+			EmailsURL:    "https://api.github.com/user/emails",
+			Scopes:       []string{"read:user", "user:email"},
+			fetchProfile: githubProfile,
+		},
+		{
+			Name:         "google",
+			Title:        "Google",
+			AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:     "https://oauth2.googleapis.com/token",
+			UserInfoURL:  "https://openidconnect.googleapis.com/v1/userinfo",
+			Scopes:       []string{"openid", "email", "profile"},
+			fetchProfile: googleProfile,
+		},
+	}
+
+	for _, p := range defaults {
+		prefix := "FORUM_" + strings.ToUpper(p.Name) + "_"
+		p.ClientID = os.Getenv(prefix + "CLIENT_ID")
+		if p.ClientID == "" {
+			continue
+		}
+		p.ClientSecret = os.Getenv(prefix + "CLIENT_SECRET")
+		p.AuthURL = envOr(prefix+"AUTH_URL", p.AuthURL)
+		p.TokenURL = envOr(prefix+"TOKEN_URL", p.TokenURL)
+		p.UserInfoURL = envOr(prefix+"USERINFO_URL", p.UserInfoURL)
+		p.EmailsURL = envOr(prefix+"EMAILS_URL", p.EmailsURL)
+		RegisterOAuthProvider(p)
+	}
+}
+
+func (p *OAuthProvider) redirectURL() string {
+	return BaseURL + "/auth/" + p.Name + "/callback"
+}
+
+// OAuthHandler serves /auth/{provider}/login and /auth/{provider}/callback
+func OAuthHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/auth/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	provider, ok := OAuthProviders[parts[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "login":
+		oauthLogin(w, r, provider)
+	case "callback":
+		oauthCallback(w, r, provider)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// send the browser to the provider's consent page
+func oauthLogin(w http.ResponseWriter, r *http.Request, p *OAuthProvider) {
+	state, err := generateToken()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.redirectURL()},
+		"scope":         {strings.Join(p.Scopes, " ")},
+		"state":         {state},
+	}
+	http.Redirect(w, r, p.AuthURL+"?"+q.Encode(), http.StatusFound)
+}
+
+// the provider sends the browser back here with a code to exchange
+func oauthCallback(w http.ResponseWriter, r *http.Request, p *OAuthProvider) {
+	// The state cookie is single use
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookieName, Value: "", Path: "/auth/", MaxAge: -1})
+
+	q := r.URL.Query()
+	cookie, err := r.Cookie(oauthStateCookieName)
+	if err != nil || q.Get("state") == "" || !tokensEqual(cookie.Value, q.Get("state")) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	if q.Get("error") != "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	accessToken, err := p.exchangeCode(q.Get("code"))
+	if err != nil {
+		log.Printf("%s token exchange: %v", p.Name, err)
+		http.Error(w, "Could not log in with "+p.Title, http.StatusBadGateway)
+		return
+	}
+
+	profile, err := p.fetchProfile(p, accessToken)
+	if err != nil {
+		log.Printf("%s profile: %v", p.Name, err)
+		http.Error(w, "Could not log in with "+p.Title, http.StatusBadGateway)
+		return
+	}
+
+	userId, err := findOrCreateOAuthUser(p.Name, profile)
+	if err != nil {
+		if err == errNoVerifiedEmail {
+			http.Error(w, "Your "+p.Title+" account needs a verified email address to log in", http.StatusForbidden)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return
+	}
+
+	// A linked account does not skip bans or two-factor authentication
+	var totpEnabled, banned bool
+	if err := DB.QueryRow("SELECT TOTPEnabled, Banned FROM Users WHERE ID = ?", userId).Scan(&totpEnabled, &banned); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not log in", http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		http.Error(w, bannedMessage, http.StatusForbidden)
+		return
+	}
+	if totpEnabled {
+		startTwoFactorLogin(w, r, userId)
+		return
+	}
+
+	Sessions.revoke(r)
+	if _, err := Sessions.Create(w, userId); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchangeCode trades the authorization code for an access token
+func (p *OAuthProvider) exchangeCode(code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL()},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := doJSON(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token: %s", token.Error)
+	}
+	return token.AccessToken, nil
+}
+
+// getJSON calls a provider API with the user's access token
+func getJSON(rawURL, accessToken string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	return doJSON(req, v)
+}
+
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := OAuthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
+
+func githubProfile(p *OAuthProvider, accessToken string) (*oauthProfile, error) {
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+	}
+	if err := getJSON(p.UserInfoURL, accessToken, &user); err != nil {
+		return nil, err
+	}
+
+	// /user only shows the public email, and without its verified flag
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(p.EmailsURL, accessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	profile := &oauthProfile{Subject: strconv.FormatInt(user.ID, 10), Login: user.Login}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			profile.Email = e.Email
+			profile.EmailVerified = true
+		}
+	}
+	return profile, nil
+}
+
+func googleProfile(p *OAuthProvider, accessToken string) (*oauthProfile, error) {
+	var user struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := getJSON(p.UserInfoURL, accessToken, &user); err != nil {
+		return nil, err
+	}
+	return &oauthProfile{
+		Subject:       user.Sub,
+		Login:         user.Name,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+	}, nil
+}
+
+// findOrCreateOAuthUser returns the user linked to the external identity.
+// Unknown identities are linked to the user with the same email, which the
+// provider must have verified, or get a new account on their first login.
+func findOrCreateOAuthUser(provider string, profile *oauthProfile) (int, error) {
+	if profile.Subject == "" {
+		return 0, errors.New("profile has no subject")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userId int
+	err = tx.QueryRow("SELECT user_id FROM user_identities WHERE provider = ? AND subject = ?", provider, profile.Subject).Scan(&userId)
+	if err == nil {
+		return userId, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// Only trust an address the provider has verified, otherwise anyone
+	// could take over an account by adding its email to their profile
+	if !profile.EmailVerified || validateEmail(profile.Email) != "" {
+		return 0, errNoVerifiedEmail
+	}
+
+	var emailVerified bool
+	err = tx.QueryRow("SELECT ID, EmailVerified FROM Users WHERE Email = ? COLLATE NOCASE", profile.Email).Scan(&userId, &emailVerified)
+	switch err {
+	case nil:
+		if !emailVerified {
+			if err := reclaimUnverifiedUser(tx, userId); err != nil {
+				return 0, err
+			}
+		}
+	case sql.ErrNoRows:
+		userId, err = createOAuthUser(tx, profile)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_identities (user_id, provider, subject, email, created_at) VALUES (?, ?, ?, ?, ?)",
+		userId, provider, profile.Subject, profile.Email, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return userId, tx.Commit()
+}
+
+// createOAuthUser adds a Users row for someone who signed up through a
+// provider. They get an unusable random password and can set a real one
+// with the forgot password form.
+func createOAuthUser(tx *sql.Tx, profile *oauthProfile) (int, error) {
+	username, err := availableUsername(tx, profile)
+	if err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := randomPasswordHash()
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("INSERT INTO Users (Email, Username, Password, EmailVerified, CreatedAt) VALUES (?, ?, ?, 1, ?)", profile.Email, username, hashedPassword, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// reclaimUnverifiedUser hands an account nobody has proven to own over to
+// the owner of its email. Whoever registered it may have done so with
+// someone else's address, so their password, two-factor setup, pending
+// tokens and sessions are all thrown away before the identity is linked.
+func reclaimUnverifiedUser(tx *sql.Tx, userId int) error {
+	hashedPassword, err := randomPasswordHash()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE Users SET Password = ?, EmailVerified = 1, TOTPEnabled = 0, TOTPSecret = NULL, TOTPLastStep = 0 WHERE ID = ?", hashedPassword, userId)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM tokens WHERE user_id = ? AND used_at IS NULL", userId); err != nil {
+		return err
+	}
+	return Sessions.DestroyAllTx(tx, userId)
+}
+
+// randomPasswordHash is the password of an account that can only log in
+// through a provider until a real one is set
+func randomPasswordHash() ([]byte, error) {
+	password, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// availableUsername turns the provider's login or the email's local part
+// into a valid username nobody has taken yet
+func availableUsername(tx *sql.Tx, profile *oauthProfile) (string, error) {
+	base := profile.Login
+	if validateUsername(cleanUsername(base)) != "" {
+		base = profile.Email[:strings.Index(profile.Email, "@")]
+	}
+	base = cleanUsername(base)
+	for len(base) < usernameMinLength {
+		base += "_"
+	}
+
+	for i := 1; ; i++ {
+		candidate := base
+		if i > 1 {
+			suffix := strconv.Itoa(i)
+			if len(candidate)+len(suffix) > usernameMaxLength {
+				candidate = candidate[:usernameMaxLength-len(suffix)]
+			}
+			candidate += suffix
+		}
+
+		var taken bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM Users WHERE Username = ? COLLATE NOCASE)", candidate).Scan(&taken)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+}
+
+// cleanUsername drops characters usernames may not contain
+func cleanUsername(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == ' ' || r == '.':
+			return '_'
+		case r == '_' || r == '-' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9'):
+			return r
+		}
+		return -1
+	}, s)
+	if len(s) > usernameMaxLength {
+		s = s[:usernameMaxLength]
+	}
+	return s
+}
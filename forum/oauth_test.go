@@ -0,0 +1,244 @@
+package forum
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeProvider is an OAuth provider whose token and userinfo endpoints
+// hand out whichever Google style profile the test registered for a code
+type fakeProvider struct {
+	*OAuthProvider
+	mu       sync.Mutex
+	profiles map[string]map[string]interface{} // by code, used as the access token too
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	f := &fakeProvider{profiles: map[string]map[string]interface{}{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"access_token": r.FormValue("code")})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		profile, ok := f.profiles[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+		f.mu.Unlock()
+		if !ok {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(profile)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	f.OAuthProvider = &OAuthProvider{
+		Name:         "fake",
+		Title:        "Fake",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		AuthURL:      srv.URL + "/authorize",
+		TokenURL:     srv.URL + "/token",
+		UserInfoURL:  srv.URL + "/userinfo",
+		fetchProfile: googleProfile,
+	}
+	RegisterOAuthProvider(f.OAuthProvider)
+	t.Cleanup(func() { delete(OAuthProviders, "fake") })
+	return f
+}
+
+// login runs the browser's side of the flow for someone the provider
+// knows as sub
+func (f *fakeProvider) login(t *testing.T, sub, email string, verified bool) *httptest.ResponseRecorder {
+	t.Helper()
+	code := "code-" + sub
+	f.mu.Lock()
+	f.profiles[code] = map[string]interface{}{"sub": sub, "email": email, "email_verified": verified, "name": "Fake " + sub}
+	f.mu.Unlock()
+
+	w := httptest.NewRecorder()
+	OAuthHandler(w, httptest.NewRequest(http.MethodGet, "/auth/fake/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d", w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := loc.Query().Get("state")
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/fake/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	OAuthHandler(w, r)
+	return w
+}
+
+// sessionUser returns who the response logged in, or 0
+func sessionUser(t *testing.T, w *httptest.ResponseRecorder) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName && c.Value != "" {
+			r.AddCookie(c)
+		}
+	}
+	id, err := Sessions.UserID(r)
+	if err != nil {
+		return 0
+	}
+	return id
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := DB.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestOAuthStateMismatch(t *testing.T) {
+	openTestDB(t)
+	newFakeProvider(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/auth/fake/callback?code=x&state=forged", nil)
+	r.AddCookie(&http.Cookie{Name: oauthStateCookieName, Value: "expected"})
+	w := httptest.NewRecorder()
+	OAuthHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/auth/fake/callback?code=x&state=forged", nil)
+	w = httptest.NewRecorder()
+	OAuthHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("without a state cookie: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestOAuthFirstLoginCreatesAccount(t *testing.T) {
+	openTestDB(t)
+	f := newFakeProvider(t)
+
+	w := f.login(t, "1001", "newcomer@example.test", true)
+	if w.Code != http.StatusFound {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	userId := sessionUser(t, w)
+	if userId == 0 {
+		t.Fatal("not logged in")
+	}
+	var email string
+	var verified bool
+	if err := DB.QueryRow("SELECT Email, EmailVerified FROM Users WHERE ID = ?", userId).Scan(&email, &verified); err != nil {
+		t.Fatal(err)
+	}
+	if email != "newcomer@example.test" || !verified {
+		t.Errorf("created user has email %q, verified %v", email, verified)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM user_identities WHERE user_id = ? AND provider = 'fake' AND subject = '1001'", userId); n != 1 {
+		t.Errorf("%d identities linked, want 1", n)
+	}
+}
+
+func TestOAuthLinksVerifiedEmail(t *testing.T) {
+	openTestDB(t)
+	f := newFakeProvider(t)
+	userId := createTestUser(t, "Owner@Example.test", "owner", "password1", true)
+
+	w := f.login(t, "1002", "owner@example.test", true)
+	if got := sessionUser(t, w); got != userId {
+		t.Fatalf("logged in as %d, want %d", got, userId)
+	}
+	var hash []byte
+	if err := DB.QueryRow("SELECT Password FROM Users WHERE ID = ?", userId).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte("password1")) != nil {
+		t.Error("linking a verified account changed its password")
+	}
+}
+
+func TestOAuthReclaimsUnverifiedAccount(t *testing.T) {
+	openTestDB(t)
+	f := newFakeProvider(t)
+	// someone registered with the victim's address before they signed up
+	userId := createTestUser(t, "victim@example.test", "squatter", "password1", false)
+	squatter, err := Sessions.Create(httptest.NewRecorder(), userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := f.login(t, "1003", "victim@example.test", true)
+	if got := sessionUser(t, w); got != userId {
+		t.Fatalf("logged in as %d, want %d", got, userId)
+	}
+	var hash []byte
+	var verified bool
+	if err := DB.QueryRow("SELECT Password, EmailVerified FROM Users WHERE ID = ?", userId).Scan(&hash, &verified); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte("password1")) == nil {
+		t.Error("the squatter's password still works")
+	}
+	if !verified {
+		t.Error("email not marked verified")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM sessions WHERE token_hash = ?", hashToken(squatter.Token)); n != 0 {
+		t.Error("the squatter's session was not destroyed")
+	}
+}
+
+func TestOAuthRefusesUnverifiedEmail(t *testing.T) {
+	openTestDB(t)
+	f := newFakeProvider(t)
+	createTestUser(t, "target@example.test", "target", "password1", true)
+	users := countRows(t, "SELECT COUNT(*) FROM Users")
+
+	w := f.login(t, "1004", "target@example.test", false)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if sessionUser(t, w) != 0 {
+		t.Error("logged in with an unverified email")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM user_identities WHERE provider = 'fake'"); n != 0 {
+		t.Errorf("%d identities linked, want 0", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Users"); n != users {
+		t.Error("an account was created")
+	}
+}
+
+func TestOAuthSecondLoginReusesIdentity(t *testing.T) {
+	openTestDB(t)
+	f := newFakeProvider(t)
+
+	first := sessionUser(t, f.login(t, "1005", "returning@example.test", true))
+	if first == 0 {
+		t.Fatal("first login failed")
+	}
+	// the identity is found by subject even after the email changed
+	second := sessionUser(t, f.login(t, "1005", "changed@example.test", true))
+	if second != first {
+		t.Errorf("second login as %d, want %d", second, first)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM user_identities WHERE provider = 'fake'"); n != 1 {
+		t.Errorf("%d identities, want 1", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM Users WHERE Email = ?", "changed@example.test"); n != 0 {
+		t.Error("a second account was created")
+	}
+}
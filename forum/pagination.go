@@ -0,0 +1,192 @@
+package forum
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// posts shown per page (FORUM_POSTS_PER_PAGE)
+var PostsPerPage = 20
+
+// an order posts can be listed in. key is the SQL expression sorted on,
+// descending, with the post ID breaking ties; ref is the Julian day the
+// listing was first loaded, so time-based scores stay put while paging.
+type postSort struct {
+	Name  string
+	Label string
+	key   func(ref float64) string
+}
+
+var postSorts = []postSort{
+	{"new", "New", func(float64) string { return "p.id" }},
+	{"top", "Top", func(float64) string { return "(p.likes_count - p.dislikes_count)" }},
+	{"comments", "Most commented", func(float64) string { return "p.comments_count" }},
+	// score divided by the square of the post's age in hours, plus two so
+	// brand new posts do not shoot to the top
+	{"hot", "Hot", func(ref float64) string {
+		age := fmt.Sprintf("((%f - julianday(p.created_at)) * 24 + 2)", ref)
+		return "((1.0 + p.likes_count - p.dislikes_count) / " + age + " / " + age + ")"
+	}},
+}
+
+func lookupPostSort(name string) (postSort, bool) {
+	for _, s := range postSorts {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return postSort{}, false
+}
+
+// a position in a listing: the sort key and ID of a post on its edge
+type cursor struct {
+	Key float64
+	ID  int
+	Ref float64
+}
+
+var errBadCursor = errors.New("invalid page cursor")
+
+// cursors are opaque to clients but are not secret; they hold nothing a
+// client could not work out from the listing
+func (c cursor) String() string {
+	raw := strconv.FormatFloat(c.Key, 'g', -1, 64) + "|" + strconv.Itoa(c.ID) + "|" + strconv.FormatFloat(c.Ref, 'g', -1, 64)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (*cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, errBadCursor
+	}
+	var c cursor
+	c.Key, err = strconv.ParseFloat(parts[0], 64)
+	if err == nil {
+		c.ID, err = strconv.Atoi(parts[1])
+	}
+	if err == nil {
+		c.Ref, err = strconv.ParseFloat(parts[2], 64)
+	}
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &c, nil
+}
+
+// which page of a listing to show. At most one of After and Before is set;
+// neither means the first page.
+type PageRequest struct {
+	Sort   postSort
+	After  *cursor // posts that come after this one
+	Before *cursor // posts that come before this one
+	Ref    float64
+}
+
+// parsePageRequest reads the sort, after and before query parameters
+func parsePageRequest(r *http.Request) (PageRequest, error) {
+	q := r.URL.Query()
+	pg := PageRequest{Sort: postSorts[0], Ref: julianDay(time.Now())}
+	if name := q.Get("sort"); name != "" {
+		s, ok := lookupPostSort(name)
+		if !ok {
+			return pg, fmt.Errorf("unknown sort %q", name)
+		}
+		pg.Sort = s
+	}
+
+	var err error
+	if after := q.Get("after"); after != "" {
+		if pg.After, err = parseCursor(after); err != nil {
+			return pg, err
+		}
+		pg.Ref = pg.After.Ref
+	} else if before := q.Get("before"); before != "" {
+		if pg.Before, err = parseCursor(before); err != nil {
+			return pg, err
+		}
+		pg.Ref = pg.Before.Ref
+	}
+	return pg, nil
+}
+
+// julianDay converts t to the day number SQLite's julianday() returns
+func julianDay(t time.Time) float64 {
+	return float64(t.UnixNano())/float64(24*time.Hour) + 2440587.5
+}
+
+// one page of a post listing, with cursors for the pages either side
+type PostPage struct {
+	Posts []Post
+	Next  string // empty on the last page
+	Prev  string // empty on the first page
+}
+
+// pageQuery adds the keyset condition, ordering and limit for pg to a query
+// selecting from posts p. The query must select the sort key last.
+func pageQuery(query string, args []interface{}, pg PageRequest) (string, []interface{}) {
+	key := pg.Sort.key(pg.Ref)
+	order := "DESC"
+	switch {
+	case pg.After != nil:
+		query += " AND (" + key + " < ? OR (" + key + " = ? AND p.id < ?))"
+		args = append(args, pg.After.Key, pg.After.Key, pg.After.ID)
+	case pg.Before != nil:
+		// walk backwards, the results are flipped afterwards
+		query += " AND (" + key + " > ? OR (" + key + " = ? AND p.id > ?))"
+		args = append(args, pg.Before.Key, pg.Before.Key, pg.Before.ID)
+		order = "ASC"
+	}
+	query += " ORDER BY " + key + " " + order + ", p.id " + order + " LIMIT ?"
+	// one extra row tells whether there is another page
+	args = append(args, PostsPerPage+1)
+	return query, args
+}
+
+// pageLinks builds the URLs for the previous and next pages and for each
+// sort, keeping the request's other query parameters
+type pageLinks struct {
+	PrevURL string
+	NextURL string
+	Sorts   []sortLink
+}
+
+type sortLink struct {
+	Label   string
+	URL     string
+	Current bool
+}
+
+func newPageLinks(r *http.Request, pg PageRequest, page *PostPage) pageLinks {
+	link := func(set map[string]string) string {
+		q := r.URL.Query()
+		q.Del("after")
+		q.Del("before")
+		for k, v := range set {
+			q.Set(k, v)
+		}
+		u := url.URL{Path: r.URL.Path, RawQuery: q.Encode()}
+		return u.String()
+	}
+
+	var links pageLinks
+	if page.Prev != "" {
+		links.PrevURL = link(map[string]string{"before": page.Prev})
+	}
+	if page.Next != "" {
+		links.NextURL = link(map[string]string{"after": page.Next})
+	}
+	for _, s := range postSorts {
+		links.Sorts = append(links.Sorts, sortLink{Label: s.Label, URL: link(map[string]string{"sort": s.Name}), Current: s.Name == pg.Sort.Name})
+	}
+	return links
+}
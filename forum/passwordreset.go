@@ -0,0 +1,215 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// how long a password reset link stays valid
+	passwordResetTTL = 1 * time.Hour
+	// reset requests one email address, or one IP address, may make within
+	// resetRequestWindow
+	maxResetRequestsPerEmail = 3
+	maxResetRequestsPerIP    = 10
+	resetRequestWindow       = 1 * time.Hour
+)
+
+// reset emails still being sent; Shutdown waits for them
+var pendingMail sync.WaitGroup
+
+// ask for a password reset link
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		PageBase
+		Sent  bool
+		Error string
+	}
+	data.PageBase = newPageBase(r)
+
+	if r.Method == http.MethodGet {
+		renderTemplate(w, "forgotPassword.html", data)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	email := r.Form.Get("email")
+	if email == "" {
+		http.Error(w, "Please fill out all fields", http.StatusBadRequest)
+		return
+	}
+
+	// Unknown addresses count towards the limits too, so being limited
+	// says nothing about whether an account exists
+	ip := clientIP(r)
+	allowed, err := resetRequestAllowed(normalizeEmail(email), ip, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		data.Error = "Too many password reset requests. Please try again later."
+		w.Header().Set("Retry-After", fmt.Sprint(int(resetRequestWindow.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		renderTemplate(w, "forgotPassword.html", data)
+		return
+	}
+	_, err = DB.Exec("INSERT INTO password_reset_requests (email, ip, created_at) VALUES (?, ?, ?)", normalizeEmail(email), ip, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// send to the address as stored, whatever case it was typed in
+	var userId int
+	err = DB.QueryRow("SELECT ID, Email FROM Users WHERE Email = ? COLLATE NOCASE", email).Scan(&userId, &email)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only send mail for known addresses, but answer the same either way so
+	// the form cannot be used to find out who has an account. The mail goes
+	// out in the background so the response does not take longer for them.
+	if err == nil {
+		pendingMail.Add(1)
+		go func() {
+			defer pendingMail.Done()
+			if err := sendPasswordReset(userId, email); err != nil {
+				log.Println("Error sending password reset:", err)
+			}
+		}()
+	}
+
+	data.Sent = true
+	renderTemplate(w, "forgotPassword.html", data)
+}
+
+// resetRequestAllowed reports whether another reset may be requested for
+// the email from the IP address
+func resetRequestAllowed(email, ip string, now time.Time) (bool, error) {
+	since := now.Add(-resetRequestWindow)
+	var byEmail, byIP int
+	err := DB.QueryRow(`SELECT
+			COUNT(CASE WHEN email = ? THEN 1 END),
+			COUNT(CASE WHEN ip = ? THEN 1 END)
+		FROM password_reset_requests WHERE (email = ? OR ip = ?) AND created_at > ?`, email, ip, email, ip, since).Scan(&byEmail, &byIP)
+	if err != nil {
+		return false, err
+	}
+	return byEmail < maxResetRequestsPerEmail && byIP < maxResetRequestsPerIP, nil
+}
+
+func sendPasswordReset(userId int, email string) error {
+	token, err := issueToken(userId, tokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	link := BaseURL + "/reset-password?token=" + url.QueryEscape(token)
+	return Mail.Send(Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password for your forum account.\n\n"+
+			"Follow this link within the next hour to choose a new one:\n\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.\n", link),
+	})
+}
+
+// choose a new password with a token from a reset email
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		PageBase
+		Token string
+		Error string
+	}
+	data.PageBase = newPageBase(r)
+
+	if r.Method == http.MethodGet {
+		data.Token = r.URL.Query().Get("token")
+		if _, err := lookupToken(data.Token, tokenPasswordReset); err != nil {
+			data.Error = "This reset link is invalid or has expired."
+		}
+		renderTemplate(w, "resetPassword.html", data)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	data.Token = r.Form.Get("token")
+	password := r.Form.Get("password")
+	if password != r.Form.Get("confirmPassword") {
+		data.Error = "Please enter the same new password twice."
+	} else {
+		data.Error = validatePassword(password)
+	}
+	if data.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "resetPassword.html", data)
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not hash password", http.StatusInternalServerError)
+		return
+	}
+
+	err = resetPassword(data.Token, hashedPassword)
+	if err == ErrInvalidToken {
+		data.Error = "This reset link is invalid or has expired."
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "resetPassword.html", data)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not update password", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+// resetPassword uses up the token and sets the new password in one
+// transaction, so a failed update leaves the link usable. It also logs out
+// everywhere in case the old password was compromised.
+func resetPassword(token string, hashedPassword []byte) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userId, err := consumeTokenTx(tx, token, tokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE Users SET Password = ? WHERE ID = ?", hashedPassword, userId); err != nil {
+		return err
+	}
+	if err := Sessions.DestroyAllTx(tx, userId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,145 @@
+package forum
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var resetLinkRe = regexp.MustCompile(`/reset-password\?token=(\S+)`)
+
+func TestPasswordReset(t *testing.T) {
+	mail := openTestDB(t)
+	userID := createTestUser(t, "Reset.Me@Example.test", "resetme", "oldpassword1", true)
+
+	// the address is matched regardless of case
+	w := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"reset.me@example.test"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("forgot password: status %d", w.Code)
+	}
+	pendingMail.Wait()
+	msgs := mail.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("sent %d messages, want 1", len(msgs))
+	}
+	if msgs[0].To != "Reset.Me@Example.test" {
+		t.Errorf("mail sent to %q, want the stored address", msgs[0].To)
+	}
+	m := resetLinkRe.FindStringSubmatch(msgs[0].Body)
+	if m == nil {
+		t.Fatalf("no reset link in %q", msgs[0].Body)
+	}
+	token, err := url.QueryUnescape(m[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"token": {token}, "password": {"newpassword2"}, "confirmPassword": {"newpassword2"}}
+	w = postForm(ResetPasswordHandler, "/reset-password", form)
+	if w.Code != http.StatusFound {
+		t.Fatalf("reset password: status %d", w.Code)
+	}
+	var hash []byte
+	if err := DB.QueryRow("SELECT Password FROM Users WHERE ID = ?", userID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte("newpassword2")) != nil {
+		t.Error("password was not changed")
+	}
+
+	// the link only works once
+	form.Set("password", "thirdpassword3")
+	form.Set("confirmPassword", "thirdpassword3")
+	w = postForm(ResetPasswordHandler, "/reset-password", form)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the token: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if err := DB.QueryRow("SELECT Password FROM Users WHERE ID = ?", userID).Scan(&hash); err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte("newpassword2")) != nil {
+		t.Error("reused token changed the password")
+	}
+}
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	mail := openTestDB(t)
+	w := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"nobody@example.test"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	pendingMail.Wait()
+	if n := len(mail.Messages()); n != 0 {
+		t.Errorf("sent %d messages for an unknown address", n)
+	}
+}
+
+func TestResetPasswordFailedUpdateKeepsToken(t *testing.T) {
+	openTestDB(t)
+	userID := createTestUser(t, "keep@example.test", "keeptoken", "oldpassword1", true)
+	token, err := issueToken(userID, tokenPasswordReset, passwordResetTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make the password update fail
+	if _, err := DB.Exec(`CREATE TRIGGER fail_password BEFORE UPDATE OF Password ON Users
+		BEGIN SELECT RAISE(ABORT, 'no'); END`); err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"token": {token}, "password": {"newpassword2"}, "confirmPassword": {"newpassword2"}}
+	w := postForm(ResetPasswordHandler, "/reset-password", form)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed update: status %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	// the link still works once the update can succeed
+	if _, err := DB.Exec("DROP TRIGGER fail_password"); err != nil {
+		t.Fatal(err)
+	}
+	w = postForm(ResetPasswordHandler, "/reset-password", form)
+	if w.Code != http.StatusFound {
+		t.Fatalf("retry: status %d, want %d", w.Code, http.StatusFound)
+	}
+}
+
+func TestForgotPasswordRateLimit(t *testing.T) {
+	mail := openTestDB(t)
+	createTestUser(t, "limited@example.test", "limited", "password123", true)
+
+	for i := 0; i < maxResetRequestsPerEmail; i++ {
+		w := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"limited@example.test"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	// the limit is per address, whatever case it is typed in
+	w := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"LIMITED@example.test"}})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the email limit: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+	pendingMail.Wait()
+	if n := len(mail.Messages()); n != maxResetRequestsPerEmail {
+		t.Errorf("sent %d messages, want %d", n, maxResetRequestsPerEmail)
+	}
+
+	// unknown addresses from the same IP count towards its limit
+	for i := maxResetRequestsPerEmail; i < maxResetRequestsPerIP; i++ {
+		email := fmt.Sprintf("nobody%d@example.test", i)
+		w := postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {email}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	w = postForm(ForgotPasswordHandler, "/forgot-password", url.Values{"email": {"someone.else@example.test"}})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the IP limit: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,168 @@
+package forum
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// a stored version of a post
+type PostRevision struct {
+	Title   string
+	Content string
+	Editor  string
+	Time    time.Time
+}
+
+// postForAction loads the post whose ID follows prefix in the URL and checks
+// the current user may act on it with the own/any permission pair
+func postForAction(w http.ResponseWriter, r *http.Request, prefix, own, any string) (*Post, bool) {
+	post, err := getPostByID(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !canModify(CurrentUser(r), post.UserID, own, any) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return post, true
+}
+
+// edit a post's title and content, keeping the old version as a revision
+func EditPostHandler(w http.ResponseWriter, r *http.Request) {
+	post, ok := postForAction(w, r, "/post-edit/", PermPostEditOwn, PermPostEditAny)
+	if !ok {
+		return
+	}
+
+	var data struct {
+		PageBase
+		Post  *Post
+		Error string
+	}
+	data.PageBase = newPageBase(r)
+	data.Post = post
+
+	if r.Method == http.MethodGet {
+		renderTemplate(w, "editPost.html", data)
+		return
+	}
+
+	post.Title = r.FormValue("postTitle")
+	post.Content = r.FormValue("postContent")
+	if post.Title == "" || post.Content == "" {
+		data.Error = "Please ensure title and post content fields are not empty!"
+	} else {
+		data.Error = validateLength("Posts", post.Content, postMaxLength)
+	}
+	if data.Error != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "editPost.html", data)
+		return
+	}
+
+	if err := savePostEdit(post, CurrentUser(r).ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not edit post", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, post.URL, http.StatusSeeOther)
+}
+
+// savePostEdit updates the post and records the new version. Posts written
+// before revisions existed get their original version stored first.
+func savePostEdit(post *Post, editorID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO post_revisions (post_id, editor_id, title, content, created_at)
+		SELECT id, user_id, title, content, created_at FROM posts
+		WHERE id = ? AND NOT EXISTS (SELECT 1 FROM post_revisions WHERE post_id = ?)`, post.ID, post.ID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE posts SET title = ?, content = ?, content_html = ?, content_html_version = ?, edited_at = ?, updated_at = ? WHERE id = ?",
+		post.Title, post.Content, renderMarkdown(post.Content), markdownVersion, now, now, post.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO post_revisions (post_id, editor_id, title, content, created_at) VALUES (?, ?, ?, ?, ?)",
+		post.ID, editorID, post.Title, post.Content, now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// soft-delete a post; its comments, reactions and revisions are kept
+func DeletePostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	post, ok := postForAction(w, r, "/post-delete/", PermPostDeleteOwn, PermPostDeleteAny)
+	if !ok {
+		return
+	}
+
+	_, err := DB.Exec("UPDATE posts SET deleted_at = ?, deleted_by = ? WHERE id = ?", time.Now(), CurrentUser(r).ID, post.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not delete post", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// list every version of a post, newest first
+func PostRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	post, err := getPostByID(strings.TrimPrefix(r.URL.Path, "/post-revisions/"))
+	if err != nil {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := getPostRevisions(post.ID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not fetch revisions", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		PageBase
+		Post      *Post
+		Revisions []PostRevision
+	}
+	data.PageBase = newPageBase(r)
+	data.Post = post
+	data.Revisions = revisions
+	renderTemplate(w, "postRevisions.html", data)
+}
+
+func getPostRevisions(postID string) ([]PostRevision, error) {
+	rows, err := DB.Query(`SELECT r.title, r.content, COALESCE(u.Username, '[unknown]'), r.created_at
+		FROM post_revisions r LEFT JOIN Users u ON u.ID = r.editor_id
+		WHERE r.post_id = ? ORDER BY r.created_at DESC, r.id DESC`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []PostRevision
+	for rows.Next() {
+		var rev PostRevision
+		if err := rows.Scan(&rev.Title, &rev.Content, &rev.Editor, &rev.Time); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
+}
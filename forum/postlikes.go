@@ -1,317 +1,56 @@
 package forum
 
 import (
-	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-var postID int
-var userID string
+func getUserID(r *http.Request) int {
+	// The logged in user is put in the context by RequireAuth
+	return CurrentUser(r).ID
+}
 
-func getPostID(w http.ResponseWriter, r *http.Request) (int, error) {
+// Handler for handling like and dislike actions
+func HandleLikesDislikes(w http.ResponseWriter, r *http.Request) {
 	// Extract post ID from URL
 	postIDStr := strings.TrimPrefix(r.URL.Path, "/post-like/")
 	postID, err := strconv.Atoi(postIDStr)
-	if err != nil { //added JB
-		return 0, fmt.Errorf("Invalid post ID: %w", err)
-	}
-	return postID, nil
-
-	// if err != nil {
-	// 	http.Error(w, "Invalid post ID", http.StatusBadRequest)
-	// }
-	// return postID
-}
-
-func getUserID(w http.ResponseWriter, r *http.Request) string {
-	// Get user ID from session cookie
-	_, userID, err := GetCookieValue(r)
 	if err != nil {
-		http.Error(w, "Cookie not found", http.StatusBadRequest)
+		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		return
 	}
-	return userID
-}
-
-// Handler for handling like and dislike actions
-func HandleLikesDislikes(w http.ResponseWriter, r *http.Request) {
-	// Check session cookie
-	checkCookies(w, r)
-
-	// Get userID
-	userID := getUserID(w, r)
 
-	// Get postID
-	postID, err := getPostID(w, r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Deleted posts can no longer be reacted to
+	if _, err := getPostByID(postIDStr); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	// Parse form data to retrieve the 'action' field
-	r.ParseForm()
-	action := r.FormValue("action")
-
-	// Check if the user has already liked/disliked the post
-	_, _, err = checkUserLikeDislike(userID, postID)
+	kind := r.FormValue("action")
+	allowed, err := canReactWith(CurrentUser(r), targetPost, postID, kind)
 	if err != nil {
-		http.Error(w, "Error checking user like/dislike", http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-
-	// Handle the like/dislike action based on user's previous interaction
-	if action == "like" {
-		err = addLike(userID, postID)
-		if err != nil {
-			http.Error(w, "Error adding like", http.StatusInternalServerError)
-			return
-		}
-	} else if action == "dislike" {
-		err = addDislike(userID, postID)
-		if err != nil {
-			http.Error(w, "Error adding dislike", http.StatusInternalServerError)
-			return
-		}
+	if !allowed {
+		http.Error(w, "You need more karma to downvote", http.StatusForbidden)
+		return
 	}
 
-	// Update the total likes and dislikes counts after the action is handled
-	err = addTotalLikesDislikes(postID)
+	err = ToggleReaction(getUserID(r), targetPost, postID, kind)
+	if err == ErrUnknownReaction {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Error updating total likes and dislikes", http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Could not save reaction", http.StatusInternalServerError)
 		return
 	}
 
 	// Redirect back to the post page
-	postIDStr := strings.TrimPrefix(r.URL.Path, "/post-like/")
 	http.Redirect(w, r, "/post/"+postIDStr, http.StatusSeeOther)
 }
-
-// // Handler for handling like and dislike actions
-// func HandleLikesDislikes(w http.ResponseWriter, r *http.Request) {
-// 	// Check session cookie
-// 	checkCookies(w, r)
-
-// 	// get postID, userID
-// 	// postID = getPostID(w, r)
-// 	userID := getUserID(w, r)
-
-// 	postID, err := getPostID(w, r)
-// 	if err != nil {
-// 		http.Error(w, err.Error(), http.StatusBadRequest)
-// 		return
-// 	}
-
-// 	r.ParseForm()
-// 	action := r.FormValue("action")
-
-// 	// Check if the user has already liked/disliked the post
-// 	_, _, err = checkUserLikeDislike(userID, postID)
-// 	if err != nil {
-// 		http.Error(w, "Error checking user like/dislike", http.StatusInternalServerError)
-// 		return
-// 	}
-
-// 	// Handle the like/dislike action based on user's previous interaction
-// 	// if r.Method == http.MethodPost {
-// 	if action == "like" {
-// 		err = addLike(userID, postID)
-// 		if err != nil {
-// 			http.Error(w, "Error adding like", http.StatusInternalServerError)
-// 			return
-// 		}
-// 	} else if action == "dislike" {
-// 		err = addDislike(userID, postID)
-// 		if err != nil {
-// 			http.Error(w, "Error adding dislike", http.StatusInternalServerError)
-// 			return
-// 		}
-// 	}
-
-// 	fmt.Println("Like/Dislike successful!")
-
-// 	// Redirect back to the post page
-// 	postIDStr := strings.TrimPrefix(r.URL.Path, "/post-like/")
-// 	http.Redirect(w, r, "/post/"+postIDStr, http.StatusSeeOther)
-// }
-
-func checkUserLikeDislike(userID string, postID int) (liked bool, disliked bool, err error) {
-	// Execute a query to check if the user has liked or disliked the post
-	row := DB.QueryRow("SELECT COUNT(*) FROM postlikes WHERE user_id = ? AND post_id = ? AND type = 1", userID, postID)
-	var likeCount int
-	if err := row.Scan(&likeCount); err != nil {
-		return false, false, err
-	}
-	liked = likeCount > 0
-
-	row = DB.QueryRow("SELECT COUNT(*) FROM postlikes WHERE user_id = ? AND post_id = ? AND type = -1", userID, postID)
-	var dislikeCount int
-	if err := row.Scan(&dislikeCount); err != nil {
-		return false, false, err
-	}
-	disliked = dislikeCount > 0
-
-	// check for data entries that have not been liked or disliked
-	row = DB.QueryRow("SELECT COUNT(*) FROM postlikes WHERE user_id = ? AND post_id = ? AND type = 0", userID, postID)
-	var neitherCount int
-	if err := row.Scan(&neitherCount); err != nil {
-		return false, false, err
-	}
-
-	// If there is a "neither" entry, treat it as a like and a dislike
-	if neitherCount > 0 {
-		liked = true
-		disliked = true
-	}
-
-	return liked, disliked, nil
-}
-
-func addLike(userID string, postID int) error {
-	// check if user has previously interacted with post
-	existingLike, existingDislike, err := checkUserLikeDislike(userID, postID)
-	if err != nil {
-		return err
-	}
-
-	if existingDislike {
-		// Replace value '-1' with '1'
-		_, err = DB.Exec("UPDATE postlikes SET type = 1 WHERE user_id = ? AND post_id = ?", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Replaced Dislike with Like")
-	} else if existingLike {
-		// Toggle value '1' to '0'
-		_, err = DB.Exec("UPDATE postlikes SET type = 0 WHERE user_id = ? AND post_id = ?", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Toggled Like to Neither")
-	} else {
-		// Insert new entry with value '1'
-		_, err = DB.Exec("INSERT INTO postlikes (user_id, post_id, type) VALUES (?, ?, 1)", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Added Like")
-	}
-
-	// Update the likes_count in the posts table
-	_, err = DB.Exec("UPDATE posts SET likes_count = likes_count + 1 WHERE id = ?", postID)
-	if err != nil {
-		return err
-	}
-	fmt.Println("Updated likes_count for the post")
-
-	return nil
-
-}
-
-func addDislike(userID string, postID int) error {
-
-	existingLike, existingDislike, err := checkUserLikeDislike(userID, postID)
-	if err != nil {
-		return err
-	}
-
-	if existingLike {
-		// Replace value '1' with '-1'
-		_, err = DB.Exec("UPDATE postlikes SET type = -1 WHERE user_id = ? AND post_id = ?", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Replaced Like with Dislike")
-	} else if existingDislike {
-		// Toggle value '-1' to '0'
-		_, err = DB.Exec("UPDATE postlikes SET type = 0 WHERE user_id = ? AND post_id = ?", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Toggled Dislike to Neither")
-	} else {
-		// Insert new entry with value '-1'
-		_, err = DB.Exec("INSERT INTO postlikes (user_id, post_id, type) VALUES (?, ?, -1)", userID, postID)
-		if err != nil {
-			return err
-		}
-		fmt.Println("Added Dislike")
-	}
-	return nil
-}
-
-// create a function to add total likes from the database postlikes table
-func getTotalLikes(postID int) (int, error) {
-	//from the postlikes table, get the total number of likes for a post
-	row := DB.QueryRow("SELECT COUNT(*) FROM postlikes WHERE post_id = ? AND type = 1", postID)
-	var likeCount int
-	if err := row.Scan(&likeCount); err != nil {
-		return 0, err
-	}
-	return likeCount, nil
-}
-
-// create a function to add total dislikes from the database postlikes table
-func getTotalDislikes(postID int) (int, error) {
-	//from the postlikes table, get the total number of dislikes for a post
-	row := DB.QueryRow("SELECT COUNT(*) FROM postlikes WHERE post_id = ? AND type = -1", postID)
-	var dislikeCount int
-	if err := row.Scan(&dislikeCount); err != nil {
-		return 0, err
-	}
-	return dislikeCount, nil
-}
-
-// adds total likes to the likes_count column in the posts table and total dislikes to the dislikes_count column in the posts table
-func addTotalLikesDislikes(postID int) error {
-	//get the total number of likes for a post
-	likeCount, err := getTotalLikes(postID)
-	if err != nil {
-		return err
-	}
-	// total number of dislikes for a post
-	dislikeCount, err := getTotalDislikes(postID)
-	if err != nil {
-		return err
-	}
-	//total number of likes to the likes_count column in the posts table
-	_, err = DB.Exec("UPDATE posts SET likes_count = ? WHERE id = ?", likeCount, postID)
-	fmt.Println(likeCount, "likes count database")
-	if err != nil {
-		return err
-	}
-	//the total number of dislikes to the dislikes_count column and return the count
-	_, err = DB.Exec("UPDATE posts SET dislikes_count = ? WHERE id = ?", dislikeCount, postID)
-	fmt.Println(dislikeCount, "dislikes count database")
-	if err != nil {
-		return err
-	}
-	return nil
-
-}
-// func getDislikesCount(postID int) (int, error) {
-// 	row := DB.QueryRow("SELECT dislikes_count FROM posts WHERE id = ?", postID)
-// 	var dislikeCount int
-// 	if err := row.Scan(&dislikeCount); err != nil {
-// 		return 0, err
-// 	}
-// 	return dislikeCount, nil
-// }
-
-// func DisplayDislikeCountHandler(w http.ResponseWriter, r *http.Request) {
-//     // 1. Retrieve the Post ID
-//     postID, err := getPostID(w, r)
-//     if err != nil {
-//         http.Error(w, err.Error(), http.StatusBadRequest)
-//         return
-//     }
-//     
-//     dislikeCount, err := getDislikesCount(postID)
-//     if err != nil {
-//         http.Error(w, "Failed to get dislike count", http.StatusInternalServerError)
-//         return
-//     }
-//     response := fmt.Sprintf("The post with ID %d has %d dislikes.", postID, dislikeCount)
-//     w.Write([]byte(response))
-// }
-
@@ -4,42 +4,21 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"html/template"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// check cookies to see if user is logged in properly
-func checkCookies(w http.ResponseWriter, r *http.Request) {
-	sessionCookie, err := r.Cookie("session")
-	if err != nil {
-		// If there is an error, it means the session cookie was not found
-		// Redirect user to login page
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-
-	if sessionCookie.Value == "" {
-		// If the session cookie is empty, the user is not logged in
-		// Redirect user to login page
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
-}
-
 // CREATE POSTS FUNCTION
 func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
-	// Check session cookie
-	checkCookies(w, r)
-
 	if r.Method == http.MethodGet {
 		// Serve create post page
-		http.ServeFile(w, r, "createPost.html")
+		renderTemplate(w, "createPost.html", newPageBase(r))
 		return
 	}
 
@@ -49,11 +28,7 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, userId, err := GetCookieValue(r)
-	if err != nil {
-		http.Error(w, "cookie not found", http.StatusBadRequest)
-		return
-	}
+	userId := CurrentUser(r).ID
 
 	titleContent := r.Form.Get("postTitle")
 	postContent := r.Form.Get("postContent")
@@ -62,55 +37,66 @@ func CreatePostHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "Error - please ensure title and post content fields are not empty!")
 		return
 	}
+	if msg := validateLength("Posts", postContent, postMaxLength); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
 
 	// Get selected categories
 	categories := r.Form["postCategories"]
 
-	// Convert categories to a comma-separated string
-	categoriesString := strings.Join(categories, ",")
-	fmt.Printf("Post categories: %s\n", categoriesString)
-
 	//added
 	dateCreated := time.Now()
-	fmt.Println(userId)
-	userIdInt, err := strconv.Atoi(userId)
+	tx, err := DB.Begin()
 	if err != nil {
-		http.Error(w, "Could not convert", http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Could not create post", http.StatusInternalServerError)
 		return
 	}
-	// - added placeholders and userintid
-	_, err = DB.Exec("INSERT INTO posts (user_id, title, content, category_id, created_at) VALUES (?, ?, ?, ?, ?)", userIdInt, titleContent, postContent, categoriesString, dateCreated)
+	defer tx.Rollback()
+	// - added placeholders and userid
+	res, err := tx.Exec("INSERT INTO posts (user_id, title, content, content_html, content_html_version, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userId, titleContent, postContent, renderMarkdown(postContent), markdownVersion, dateCreated)
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Could not create post", http.StatusInternalServerError)
 		return
 	}
-
-	fmt.Println("Post successfully created!")
-
-	// Redirect the user to the homepage
-	http.Redirect(w, r, "/", http.StatusFound)
-}
-
-func GetCookieValue(r *http.Request) (string, string, error) {
-	//- indices represent the split to cookie and value
-	cookie, err := r.Cookie("session")
+	postID, err := res.LastInsertId()
+	if err == nil {
+		err = setPostCategories(tx, postID, categories)
+	}
+	if err == errUnknownCategory {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		return "", "", err
+		log.Println(err)
+		http.Error(w, "Could not create post", http.StatusInternalServerError)
+		return
 	}
-	value := strings.Split(cookie.Value, "&")
 
-	return value[0], value[1], nil
+	// Redirect the user to the homepage
+	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 // get post ID
 func getPostByID(postID string) (*Post, error) {
 	//added
 	// Adjusted the SELECT query to also get the `dislike_count`
-	row := DB.QueryRow("SELECT id, title, content, created_at, likes_count, dislikes_count FROM posts WHERE id = ?", postID)
+	// Deleted posts are left in the table but treated as gone
+	row := DB.QueryRow(`SELECT p.id, COALESCE(p.user_id, 0), p.title, p.content, p.content_html, p.content_html_version, p.created_at, p.likes_count, p.dislikes_count, p.locked, p.edited_at,
+			COALESCE(u.Username, ''), COALESCE(u.Karma, 0)
+		FROM posts p LEFT JOIN Users u ON u.ID = p.user_id WHERE p.id = ? AND p.deleted_at IS NULL`, postID)
 	var post Post
+	var editedAt sql.NullTime
+	var cache cachedHTML
 	// Added &post.DislikeCount at the end
-	err := row.Scan(&post.ID, &post.Title, &post.Content, &post.Time, &post.LikesCount, &post.DislikeCount)
+	err := row.Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &cache.HTML, &cache.Version, &post.Time, &post.LikesCount, &post.DislikeCount, &post.Locked, &editedAt,
+		&post.Author, &post.AuthorKarma)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, errors.New("post not found")
@@ -126,42 +112,104 @@ func getPostByID(postID string) (*Post, error) {
 	// 	}
 	// 	return nil, err
 	// }
-	// Format the datetime string
-	t, err := time.Parse("2006-01-02T15:04:05.999999999-07:00", post.Time)
+	post.ContentHTML = cache.render("posts", post.ID, post.Content)
+	post.EditedAt = editedAt.Time
+	post.Categories, err = getPostCategories(post.ID)
 	if err != nil {
 		return nil, err
 	}
-	post.Time = t.Format("January 2, 2006, 15:04:05")
 	// make post URLs
 	post.URL = "/post/" + post.ID
 	return &post, nil
 }
 
-func getCommentsByPostID(postID string) ([]Comment, error) {
-	comments := []Comment{} // creating an empty slice to store comments from the database //i've also added postID and userID to the comment struct
-	rows, err := DB.Query("SELECT user_id, post_id, content, created_at FROM comments WHERE post_id = ?", postID)
+// getCommentsByPostID returns a post's top-level comments as the user should
+// see them, with replies nested under each. Deleted and hidden comments keep
+// their place with their content replaced.
+func getCommentsByPostID(postID string, user *User) ([]*Comment, error) {
+	comments := []*Comment{} // creating an empty slice to store comments from the database //i've also added postID and userID to the comment struct
+	rows, err := DB.Query(`SELECT c.id, COALESCE(c.user_id, 0), c.post_id, COALESCE(c.parent_id, 0), c.content, c.content_html, c.content_html_version, c.created_at, c.edited_at, c.deleted_at IS NOT NULL, c.hidden,
+			c.likes_count, c.dislikes_count, COALESCE(u.Username, ''), COALESCE(u.Karma, 0)
+		FROM comments c LEFT JOIN Users u ON u.ID = c.user_id
+		WHERE c.post_id = ? ORDER BY c.created_at, c.id`, postID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var caches []cachedHTML
 	for rows.Next() {
-		var comment Comment
-		err := rows.Scan(&comment.UserID, &comment.PostID, &comment.Content, &comment.Time)
+		comment := &Comment{}
+		var editedAt sql.NullTime
+		var cache cachedHTML
+		err := rows.Scan(&comment.ID, &comment.UserID, &comment.PostID, &comment.ParentID, &comment.Content, &cache.HTML, &cache.Version, &comment.Time, &editedAt, &comment.Deleted, &comment.Hidden,
+			&comment.Likes, &comment.Dislikes, &comment.Author, &comment.AuthorKarma)
 		if err != nil {
 			return nil, err
 		}
-		t, err := time.Parse("2006-01-02T15:04:05.999999999-07:00", comment.Time)
-		if err != nil {
-			return nil, err
+		comment.EditedAt = editedAt.Time
+		switch {
+		case comment.Deleted:
+			comment.Content = deletedCommentText
+			comment.ContentHTML = template.HTML(renderMarkdown(comment.Content))
+		case comment.Hidden && !user.Can(PermCommentHide):
+			comment.Content = hiddenCommentText
+			comment.ContentHTML = template.HTML(renderMarkdown(comment.Content))
+		default:
+			comment.CanEdit = canModify(user, comment.UserID, PermCommentEditOwn, PermCommentEditAny)
+			comment.CanDelete = canModify(user, comment.UserID, PermCommentDeleteOwn, PermCommentDeleteAny)
 		}
-		comment.Time = t.Format("January 2, 2006, 15:04:05")
 		comments = append(comments, comment)
+		caches = append(caches, cache)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, err
 	}
-	return comments, nil
+	// placeholders are rendered above; the rest come from the cache
+	for i, c := range comments {
+		if c.ContentHTML == "" {
+			c.ContentHTML = caches[i].render("comments", c.ID, c.Content)
+		}
+	}
+
+	counts, err := reactionCounts(viewerID(user), targetComment, "SELECT id FROM comments WHERE post_id = ?", postID)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range comments {
+		if c.Reactions = counts[c.ID]; c.Reactions == nil {
+			c.Reactions = zeroReactionCounts()
+		}
+	}
+	return commentTree(comments), nil
+}
+
+// commentTree nests comments under their parents and returns the top-level
+// ones. Replies whose parent is missing are shown at the top level.
+func commentTree(comments []*Comment) []*Comment {
+	byID := make(map[int]*Comment, len(comments))
+	for _, c := range comments {
+		byID[c.ID] = c
+	}
+
+	var roots []*Comment
+	for _, c := range comments {
+		if parent, ok := byID[c.ParentID]; ok && c.ParentID != c.ID {
+			parent.Replies = append(parent.Replies, c)
+		} else {
+			roots = append(roots, c)
+		}
+	}
+	setCommentDepth(roots, 0)
+	return roots
+}
+
+func setCommentDepth(comments []*Comment, depth int) {
+	for _, c := range comments {
+		c.Depth = depth
+		c.CanReply = !c.Deleted && depth < MaxCommentDepth
+		setCommentDepth(c.Replies, depth+1)
+	}
 }
 
 func PostPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -173,7 +221,7 @@ func PostPageHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid post ID", http.StatusBadRequest)
 		return
 	}
-	var comments []Comment
+	var comments []*Comment
 
 	// Get the post data by calling the getPostByID function or fetching it from the database
 	post, err := getPostByID(postIDStr)
@@ -187,22 +235,31 @@ func PostPageHandler(w http.ResponseWriter, r *http.Request) {
 	dislikeCount := post.DislikeCount
 
 	//get comments by postID -
-	comments, err = getCommentsByPostID(postIDStr)
+	comments, err = getCommentsByPostID(postIDStr, CurrentUser(r))
 	if err != nil {
 		http.Error(w, "Could not fetch comments", http.StatusInternalServerError)
 		return
 	}
 
 	// Assuming your Post struct has a field named PostID
+	user := CurrentUser(r)
 	var data struct {
-		PostID   int
-		Post     Post
-		Comments []Comment
-		Likes    int
-		Dislikes int
-		Success  bool // Add the Success field to indicate if the comment was successfully posted
+		PageBase
+		CanEdit   bool
+		CanDelete bool
+		PostID    int
+		Post      Post
+		Comments  []*Comment
+		Likes     int
+		Dislikes  int
+		Reactions []ReactionCount
+		Reactors  []Reactor // who reacted, for the "who reacted" list
+		Success   bool      // Add the Success field to indicate if the comment was successfully posted
 	}
 
+	data.PageBase = newPageBase(r)
+	data.CanEdit = canModify(user, post.UserID, PermPostEditOwn, PermPostEditAny)
+	data.CanDelete = canModify(user, post.UserID, PermPostDeleteOwn, PermPostDeleteAny)
 	data.PostID = postID
 	data.Post = *post // Use the dereferenced post pointer
 	data.Comments = comments
@@ -210,20 +267,50 @@ func PostPageHandler(w http.ResponseWriter, r *http.Request) {
 	data.Likes = likesCount
 	data.Dislikes = dislikeCount
 
-	fmt.Println(likesCount, "likes count")
-	fmt.Println(dislikeCount, "dislike count")
-
-	tmpl, err := template.ParseFiles("postPage.html")
+	counts, err := reactionCounts(viewerID(user), targetPost, "?", postID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not fetch reactions", http.StatusInternalServerError)
+		return
+	}
+	if data.Reactions = counts[postID]; data.Reactions == nil {
+		data.Reactions = zeroReactionCounts()
+	}
+	data.Reactors, err = reactors(targetPost, postID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println(err)
+		http.Error(w, "Could not fetch reactions", http.StatusInternalServerError)
 		return
 	}
 
 	// Render the template with the data
-	// ! error flag
-	err = tmpl.ExecuteTemplate(w, "postPage.html", data)
+	renderTemplate(w, "postPage.html", data)
+}
+
+// lock or unlock a post so no more comments can be added
+func LockPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	postIDStr := strings.TrimPrefix(r.URL.Path, "/post-lock/")
+	postID, err := strconv.Atoi(postIDStr)
 	if err != nil {
-		http.Error(w, "Internal Server Error - posts", http.StatusInternalServerError)
+		http.Error(w, "Invalid post ID", http.StatusBadRequest)
 		return
 	}
+
+	locked := r.FormValue("action") == "lock"
+	res, err := DB.Exec("UPDATE posts SET locked = ? WHERE id = ?", locked, postID)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not lock post", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "post not found", http.StatusNotFound)
+		return
+	}
+
+	http.Redirect(w, r, "/post/"+postIDStr, http.StatusSeeOther)
 }
@@ -0,0 +1,156 @@
+package forum
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// how many posts and comments a profile page lists
+const profileListLimit = 20
+
+// a comment as listed on its author's profile
+type profileComment struct {
+	ContentHTML template.HTML
+	Time        time.Time
+	PostTitle   string
+	URL         string
+}
+
+// show a user's join date, karma, reactions and latest posts and comments
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimPrefix(r.URL.Path, "/user/")
+
+	var data struct {
+		PageBase
+		Username string
+		Role     Role
+		Karma    int
+		Joined   time.Time // zero if unknown
+		Received []ReactionCount
+		Given    int
+		Posts    []Post
+		Comments []profileComment
+	}
+	data.PageBase = newPageBase(r)
+
+	var userID int
+	var joined sql.NullTime
+	err := DB.QueryRow("SELECT ID, Username, Role, Karma, CreatedAt FROM Users WHERE Username = ? COLLATE NOCASE", username).
+		Scan(&userID, &data.Username, &data.Role, &data.Karma, &joined)
+	if err == sql.ErrNoRows {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+	data.Joined = joined.Time
+	if err == nil {
+		data.Received, data.Given, err = reactionTotals(userID)
+	}
+	if err == nil {
+		data.Posts, err = profilePosts(userID)
+	}
+	if err == nil {
+		data.Comments, err = profileComments(userID)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not load profile", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, "profile.html", data)
+}
+
+// reactionTotals counts the reactions of each enabled kind a user's posts
+// and comments received from others, and how many reactions they gave.
+// Reactions to their own posts and comments are left out, as for karma.
+func reactionTotals(userID int) ([]ReactionCount, int, error) {
+	rows, err := DB.Query(`SELECT r.kind, COUNT(*) FROM reactions r
+		LEFT JOIN posts p ON r.target_type = 'post' AND p.id = r.target_id
+		LEFT JOIN comments c ON r.target_type = 'comment' AND c.id = r.target_id
+		WHERE COALESCE(p.user_id, c.user_id) = ? AND r.user_id != ?
+		GROUP BY r.kind`, userID, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	received := zeroReactionCounts()
+	for rows.Next() {
+		var kind string
+		var n int
+		if err := rows.Scan(&kind, &n); err != nil {
+			return nil, 0, err
+		}
+		for i := range received {
+			if received[i].Name == kind {
+				received[i].Count = n
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var given int
+	err = DB.QueryRow("SELECT COUNT(*) FROM reactions WHERE user_id = ?", userID).Scan(&given)
+	return received, given, err
+}
+
+func profilePosts(userID int) ([]Post, error) {
+	rows, err := DB.Query(`SELECT id, title, created_at FROM posts
+		WHERE user_id = ? AND deleted_at IS NULL ORDER BY id DESC LIMIT ?`, userID, profileListLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []Post
+	for rows.Next() {
+		var post Post
+		if err := rows.Scan(&post.ID, &post.Title, &post.Time); err != nil {
+			return nil, err
+		}
+		post.URL = "/post/" + post.ID
+		posts = append(posts, post)
+	}
+	return posts, rows.Err()
+}
+
+// profileComments lists comments that are still visible to everyone
+func profileComments(userID int) ([]profileComment, error) {
+	rows, err := DB.Query(`SELECT c.id, c.post_id, c.content, c.content_html, c.content_html_version, c.created_at, p.title
+		FROM comments c JOIN posts p ON p.id = c.post_id
+		WHERE c.user_id = ? AND c.deleted_at IS NULL AND c.hidden = 0 AND p.deleted_at IS NULL
+		ORDER BY c.id DESC LIMIT ?`, userID, profileListLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var comments []profileComment
+	var sources []Comment
+	var caches []cachedHTML
+	for rows.Next() {
+		var c Comment
+		var pc profileComment
+		var cache cachedHTML
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Content, &cache.HTML, &cache.Version, &pc.Time, &pc.PostTitle); err != nil {
+			return nil, err
+		}
+		pc.URL = commentURL(&c)
+		comments = append(comments, pc)
+		sources = append(sources, c)
+		caches = append(caches, cache)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range comments {
+		comments[i].ContentHTML = caches[i].render("comments", sources[i].ID, sources[i].Content)
+	}
+	return comments, nil
+}
@@ -0,0 +1,270 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// what a reaction can be attached to
+const (
+	targetPost    = "post"
+	targetComment = "comment"
+)
+
+// reaction kinds with their own counter columns
+const (
+	reactionLike    = "like"
+	reactionDislike = "dislike"
+)
+
+// a kind of reaction and the emoji it is shown as
+type ReactionKind struct {
+	Name  string
+	Emoji string
+}
+
+// every kind the forum knows about, in display order
+var allReactionKinds = []ReactionKind{
+	{reactionLike, "👍"},
+	{"love", "❤️"},
+	{"laugh", "😂"},
+	{"wow", "😮"},
+	{"sad", "😢"},
+	{reactionDislike, "👎"},
+}
+
+// the kinds users can pick from; set with FORUM_REACTION_KINDS, e.g.
+// "like,love,dislike". Reactions of kinds that are switched off later stay
+// in the database but are not shown.
+var ReactionKinds = allReactionKinds
+
+var ErrUnknownReaction = errors.New("unknown reaction")
+
+// configureReactionKindsFromEnv picks the enabled kinds from
+// FORUM_REACTION_KINDS, ignoring names that are not in allReactionKinds
+func configureReactionKindsFromEnv() {
+	names := os.Getenv("FORUM_REACTION_KINDS")
+	if names == "" {
+		return
+	}
+	var kinds []ReactionKind
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		kind, ok := lookupReactionKind(allReactionKinds, name)
+		if !ok {
+			log.Printf("ignoring unknown reaction kind %q", name)
+			continue
+		}
+		kinds = append(kinds, kind)
+	}
+	if len(kinds) > 0 {
+		ReactionKinds = kinds
+	}
+}
+
+func lookupReactionKind(kinds []ReactionKind, name string) (ReactionKind, bool) {
+	for _, k := range kinds {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return ReactionKind{}, false
+}
+
+// how many times a target got one kind of reaction
+type ReactionCount struct {
+	ReactionKind
+	Count int
+	Mine  bool // the viewing user reacted with this kind
+}
+
+// someone who reacted to a target
+type Reactor struct {
+	Username string
+	ReactionKind
+}
+
+// tables holding each target type, with the denormalized counter column for
+// each kind that has one
+var reactionTargets = map[string]struct {
+	table    string
+	counters map[string]string
+}{
+	targetPost: {"posts", map[string]string{
+		reactionLike:    "likes_count",
+		reactionDislike: "dislikes_count",
+	}},
+	targetComment: {"comments", map[string]string{
+		reactionLike:    "likes_count",
+		reactionDislike: "dislikes_count",
+	}},
+}
+
+// ToggleReaction applies a user's reaction to a post or comment. Reacting
+// with the kind the user already chose takes it back; a different kind
+// replaces it. The reaction and the target's counters change in one
+// transaction, which the connection's _txlock=immediate starts as a write
+// so concurrent toggles queue up instead of reading stale rows.
+func ToggleReaction(userID int, targetType string, targetID int, kind string) error {
+	target, ok := reactionTargets[targetType]
+	if !ok {
+		return fmt.Errorf("unknown reaction target %q", targetType)
+	}
+	if _, ok := lookupReactionKind(ReactionKinds, kind); !ok {
+		return ErrUnknownReaction
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	err = tx.QueryRow("SELECT kind FROM reactions WHERE user_id = ? AND target_type = ? AND target_id = ?",
+		userID, targetType, targetID).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec("INSERT INTO reactions (user_id, target_type, target_id, kind, created_at) VALUES (?, ?, ?, ?, ?)",
+			userID, targetType, targetID, kind, time.Now())
+	case previous == kind:
+		_, err = tx.Exec("DELETE FROM reactions WHERE user_id = ? AND target_type = ? AND target_id = ?",
+			userID, targetType, targetID)
+		kind = ""
+	default:
+		_, err = tx.Exec("UPDATE reactions SET kind = ?, created_at = ? WHERE user_id = ? AND target_type = ? AND target_id = ?",
+			kind, time.Now(), userID, targetType, targetID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := adjustCounter(tx, target.table, target.counters[previous], targetID, -1); err != nil {
+		return err
+	}
+	if err := adjustCounter(tx, target.table, target.counters[kind], targetID, 1); err != nil {
+		return err
+	}
+	if err := awardKarma(tx, target.table, targetID, userID, previous, kind); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// adjustCounter adds delta to a counter column; kinds without a column are
+// skipped. table and column only ever come from reactionTargets.
+func adjustCounter(tx *sql.Tx, table, column string, id, delta int) error {
+	if column == "" {
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = %s + ? WHERE id = ?", table, column, column), delta, id)
+	return err
+}
+
+// reactionCounts counts the enabled kinds of reaction on each of the given
+// targets, with zero counts included so every kind can be offered.
+// where selects the targets' IDs, e.g. "SELECT id FROM comments WHERE post_id = ?".
+func reactionCounts(viewerID int, targetType, where string, args ...interface{}) (map[int][]ReactionCount, error) {
+	args = append([]interface{}{viewerID, targetType}, args...)
+	rows, err := DB.Query(`SELECT target_id, kind, COUNT(*), MAX(user_id = ?) FROM reactions
+		WHERE target_type = ? AND target_id IN (`+where+`)
+		GROUP BY target_id, kind`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct {
+		id   int
+		kind string
+	}
+	found := map[key]ReactionCount{}
+	ids := map[int]bool{}
+	for rows.Next() {
+		var id int
+		var c ReactionCount
+		if err := rows.Scan(&id, &c.Name, &c.Count, &c.Mine); err != nil {
+			return nil, err
+		}
+		found[key{id, c.Name}] = c
+		ids[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	counts := map[int][]ReactionCount{}
+	for id := range ids {
+		counts[id] = make([]ReactionCount, len(ReactionKinds))
+		for i, kind := range ReactionKinds {
+			c := found[key{id, kind.Name}]
+			c.ReactionKind = kind
+			counts[id][i] = c
+		}
+	}
+	return counts, nil
+}
+
+// canReactWith reports whether the user may pick a kind of reaction on a
+// target. Downvoting can be restricted, but a reaction the user already
+// gave can always be taken back.
+func canReactWith(u *User, targetType string, targetID int, kind string) (bool, error) {
+	if kind != reactionDislike || u.Can(PermReactionDislike) {
+		return true, nil
+	}
+	var mine bool
+	err := DB.QueryRow("SELECT EXISTS (SELECT 1 FROM reactions WHERE user_id = ? AND target_type = ? AND target_id = ? AND kind = ?)",
+		u.ID, targetType, targetID, kind).Scan(&mine)
+	return mine, err
+}
+
+// viewerID is the ID of the user looking at a page, or 0 for guests
+func viewerID(u *User) int {
+	if u == nil {
+		return 0
+	}
+	return u.ID
+}
+
+// zeroReactionCounts is what a target nobody reacted to shows
+func zeroReactionCounts() []ReactionCount {
+	counts := make([]ReactionCount, len(ReactionKinds))
+	for i, kind := range ReactionKinds {
+		counts[i].ReactionKind = kind
+	}
+	return counts
+}
+
+// reactors lists who reacted to a target with one of the enabled kinds,
+// most recent first
+func reactors(targetType string, targetID int) ([]Reactor, error) {
+	rows, err := DB.Query(`SELECT COALESCE(u.Username, '[unknown]'), r.kind
+		FROM reactions r LEFT JOIN Users u ON u.ID = r.user_id
+		WHERE r.target_type = ? AND r.target_id = ?
+		ORDER BY r.created_at DESC, r.id DESC`, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Reactor
+	for rows.Next() {
+		var username, name string
+		if err := rows.Scan(&username, &name); err != nil {
+			return nil, err
+		}
+		if kind, ok := lookupReactionKind(ReactionKinds, name); ok {
+			list = append(list, Reactor{Username: username, ReactionKind: kind})
+		}
+	}
+	return list, rows.Err()
+}
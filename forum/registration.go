@@ -2,37 +2,29 @@ package forum
 
 import (
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
-	"math/rand"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 
 	// "github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// generate random session ID
-const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-
-func init() {
-	rand.NewSource(time.Now().UnixNano())
-}
-
-func generateUserID(length int) string {
-	result := make([]byte, length)
-	for i := range result {
-		result[i] = charset[rand.Intn(len(charset))]
-	}
-	return string(result)
+// values and per-field errors for re-rendering the registration form
+type registerPageData struct {
+	PageBase
+	Email     string
+	Username  string
+	Errors    FormErrors
+	Providers []*OAuthProvider // offered instead of a password
 }
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		http.ServeFile(w, r, "register.html")
+		renderTemplate(w, "register.html", registerPageData{PageBase: newPageBase(r), Providers: oauthProviderList()})
 		return
 	}
 
@@ -41,17 +33,31 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Could not parse form", http.StatusBadRequest)
 		return
 	}
-	email := r.Form.Get("email")
-	username := r.Form.Get("username")
+	email := strings.TrimSpace(r.Form.Get("email"))
+	username := strings.TrimSpace(r.Form.Get("username"))
 	password := r.Form.Get("password")
 
-	if email == "" || username == "" || password == "" {
-		http.Error(w, "Please fill out all fields", http.StatusBadRequest)
+	// The password is never sent back to the browser
+	data := registerPageData{PageBase: newPageBase(r), Email: email, Username: username, Providers: oauthProviderList()}
+
+	data.Errors = validateRegistration(email, username, password)
+	if len(data.Errors) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "register.html", data)
 		return
 	}
 
-	// Generate a new session ID for the user
-	sessionID := generateUserID(10)
+	data.Errors, err = checkUserExists(email, username)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(data.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		renderTemplate(w, "register.html", data)
+		return
+	}
 
 	// Hash the password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -61,27 +67,85 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert the user into the database with the new session ID
-	_, err = DB.Exec("INSERT INTO Users (Email, Username, Password, SessionID) VALUES (?, ?, ?, ?)", email, username, hashedPassword, sessionID)
+	// Insert the user into the database
+	res, err := DB.Exec("INSERT INTO Users (Email, Username, Password, CreatedAt) VALUES (?, ?, ?, ?)", email, username, hashedPassword, time.Now())
+	if err != nil {
+		// Someone may have taken the email or username since the check above
+		if field := duplicateUserField(err); field != "" {
+			data.Errors = FormErrors{field: duplicateMessages[field]}
+			w.WriteHeader(http.StatusConflict)
+			renderTemplate(w, "register.html", data)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
+		return
+	}
+	userId, err := res.LastInsertId()
 	if err != nil {
 		log.Println(err)
 		http.Error(w, "Could not create user", http.StatusInternalServerError)
 		return
 	}
-	fmt.Println("User registered")
 
-	// Set a session cookie to indicate that the user is logged in
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session",
-		Value:   sessionID,
-		Expires: time.Now().Add(1 * time.Hour),
-		Path:    "/",
-	})
+	if err := sendVerificationEmail(int(userId), email); err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+
+	// Start a session so the user is logged in
+	if _, err := Sessions.Create(w, int(userId)); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
 
 	// Redirect the user to the homepage, where the logout button will be displayed
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
+var duplicateMessages = map[string]string{
+	"email":    "An account with this email address already exists.",
+	"username": "This username is already taken.",
+}
+
+// checkUserExists reports which of the email and username are already in use
+func checkUserExists(email, username string) (FormErrors, error) {
+	errs := FormErrors{}
+	var emailTaken, usernameTaken bool
+	err := DB.QueryRow(`SELECT
+		EXISTS (SELECT 1 FROM Users WHERE Email = ? COLLATE NOCASE),
+		EXISTS (SELECT 1 FROM Users WHERE Username = ? COLLATE NOCASE)`, email, username).Scan(&emailTaken, &usernameTaken)
+	if err != nil {
+		return nil, err
+	}
+	if emailTaken {
+		errs["email"] = duplicateMessages["email"]
+	}
+	if usernameTaken {
+		errs["username"] = duplicateMessages["username"]
+	}
+	return errs, nil
+}
+
+// duplicateUserField maps a unique constraint error from inserting into
+// Users to the form field it is about
+func duplicateUserField(err error) string {
+	if !isUniqueViolation(err) {
+		return ""
+	}
+	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "username") {
+		return "username"
+	}
+	return "email"
+}
+
+// isUniqueViolation reports whether err comes from a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
 // func removeOldSession(sessionCookieValue string) {
 // 	// Split the sessionCookieValue to get the session ID
 // 	parts := strings.Split(sessionCookieValue, "&")
@@ -101,25 +165,18 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 // 	}
 // }
 
+type loginPageData struct {
+	PageBase
+	Email     string
+	Error     string
+	Providers []*OAuthProvider
+}
+
 // handle login + session cookies
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
-	// Check if the user already has an active session
-	existingSessionID, _ := r.Cookie("session")
-	if existingSessionID != nil {
-		LogoutHandler(w, r)
-	}
-
-	// Generate a new session ID
-	newSessionID := generateUserID(10)
-	fmt.Println(newSessionID)
-
-	if r.Method == http.MethodGet {
-		http.ServeFile(w, r, "login.html")
-		return
-	}
-
+	data := loginPageData{PageBase: newPageBase(r), Providers: oauthProviderList()}
 	if r.Method == http.MethodGet {
-		http.ServeFile(w, r, "login.html")
+		renderTemplate(w, "login.html", data)
 		return
 	}
 
@@ -129,105 +186,91 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email := r.Form.Get("email")
+	email := normalizeEmail(r.Form.Get("email"))
 	password := r.Form.Get("password")
+	data.Email = email
 	if email == "" || password == "" {
-		http.Error(w, "Please fill out all fields", http.StatusBadRequest)
+		data.Error = "Please fill out all fields"
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "login.html", data)
 		return
 	}
 
-	var userId int
-	var storedPassword []byte // holds the hashed password from the database
-	err = DB.QueryRow("SELECT ID, password FROM Users WHERE email = ?", email).Scan(&userId, &storedPassword)
+	ip := clientIP(r)
+	wait, err := loginRetryAfter(email, ip, time.Now())
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "No user found with this email", http.StatusUnauthorized)
-		} else {
-			log.Println(err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		data.Error = tooManyLoginAttemptsMessage(wait)
+		tooManyLoginAttempts(w, "login.html", data, wait)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword(storedPassword, []byte(password))
-	if err != nil {
-		http.Error(w, "Incorrect password", http.StatusUnauthorized)
+	var userId int
+	var storedPassword []byte // holds the hashed password from the database
+	var totpEnabled, banned bool
+	err = DB.QueryRow("SELECT ID, password, TOTPEnabled, Banned FROM Users WHERE email = ? COLLATE NOCASE", email).
+		Scan(&userId, &storedPassword, &totpEnabled, &banned)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
+	if err == sql.ErrNoRows {
+		// Still run bcrypt so unknown emails take as long as real ones
+		storedPassword = dummyPasswordHash
+	}
 
-	// check if sessionID already exists
-	// query := "SELECT COUNT(*) FROM Users WHERE Email = ? AND sessionID = ?"
+	if bcrypt.CompareHashAndPassword(storedPassword, []byte(password)) != nil || err == sql.ErrNoRows {
+		recordLoginAttempt(email, ip, false)
+		data.Error = invalidLoginMessage
+		w.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(w, "login.html", data)
+		return
+	}
 
-	// var count int
-	// err = DB.QueryRow(query, email, newSessionID).Scan(&count)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return
-	// }
+	if banned {
+		data.Error = bannedMessage
+		w.WriteHeader(http.StatusForbidden)
+		renderTemplate(w, "login.html", data)
+		return
+	}
 
-	// // if sessionID already exists, user stays logged in
-	// if count > 0 {
-	// 	fmt.Printf("SessionID '%s' exists for Email '%s'\n", newSessionID, email)
-	// } else { // if sessionID does not exist, user is logged out
-	// 	fmt.Printf("SessionID '%s' does not exist for Email '%s'\n", newSessionID, email)
-	// }
+	// Users with two-factor authentication still need to enter a code. The
+	// attempt only counts as successful once that is done.
+	if totpEnabled {
+		startTwoFactorLogin(w, r, userId)
+		return
+	}
+	recordLoginAttempt(email, ip, true)
 
-	// insert session ID into database
-	_, err = DB.Exec("UPDATE Users SET SessionID = ? WHERE Email = ?", newSessionID, email)
-	if err != nil {
+	// Replace any session this browser already had
+	Sessions.revoke(r)
+	if _, err := Sessions.Create(w, userId); err != nil {
 		log.Println(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
 		return
 	}
 
-	// // Set browser cookies to store login
-	// http.SetCookie(w, &http.Cookie{
-	// 	Name:  "user",
-	// 	Value: email,
-	// })
-
-	// Store the new session ID in a cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:    "session",
-		Value:   newSessionID + "&" + strconv.Itoa(userId),
-		Expires: time.Now().Add(1 * time.Hour),
-		Path:    "/",
-	})
-
 	// Redirect the user to the homepage
 	http.Redirect(w, r, "/", http.StatusFound)
-
-	// // Create a new cookie with the session ID
-	// cookie := http.Cookie{
-	// 	Name:    "session",
-	// 	Value:   newSessionID + "&" + strconv.Itoa(userId),
-	// 	Expires: time.Now().Add(1 * time.Hour), // Extend cookie expiration time
-	// 	Path:    "/",
-	// }
-
-	// Set the cookie in the response headers
-	// http.SetCookie(w, &cookie)
-
-	// Redirect the user to the homepage
-	// http.Redirect(w, r, "/", http.StatusFound)
 }
 
 // handle logging out
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	// Clear the session data from the database
-	sessionCookie, err := r.Cookie("session")
-	if err == nil {
-		sessionID := strings.Split(sessionCookie.Value, "&")[0]
-		clearSessionFromDB(sessionID)
+	// Only a POST with a CSRF token may log someone out
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// Clear session and user cookies
-	http.SetCookie(w, &http.Cookie{
-		Name:   "session",
-		Value:  "",
-		MaxAge: -1, // Expire immediately
-		Path:   "/",
-	})
+	// Clear the session data from the database and the session cookie
+	Sessions.Destroy(w, r)
+
+	// Clear the old user cookie
 	http.SetCookie(w, &http.Cookie{
 		Name:   "user",
 		Value:  "",
@@ -238,14 +281,3 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	// Redirect the user to the login page
 	http.Redirect(w, r, "/login", http.StatusFound)
 }
-
-// clearSessionFromDB removes the session data from the database
-func clearSessionFromDB(sessionID string) {
-	// Implement code to clear the session from the database by setting SessionID to NULL
-	query := "UPDATE Users SET SessionID = NULL WHERE SessionID = ?"
-	_, err := DB.Exec(query, sessionID)
-	if err != nil {
-		// Handle the error, e.g., log it
-		log.Println("Error clearing session from the database:", err)
-	}
-}
@@ -0,0 +1,134 @@
+package forum
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Every page in TemplateDir is parsed once at startup together with
+// layout.html and the files in partials/. Pages define a "content" block,
+// and optionally a "title", which the layout wraps in the shared header.
+var (
+	TemplateDir = "templates"
+	// TemplateReload parses the templates again on every render, so they
+	// can be edited without restarting the server
+	TemplateReload = false
+
+	templatesMu sync.RWMutex
+	templates   map[string]*template.Template // by page file name
+)
+
+// functions available in every template
+var templateFuncs = template.FuncMap{
+	"dict":       dict,
+	"formatTime": formatTime,
+	"userURL":    userURL,
+}
+
+// dict builds a map from alternating keys and values, for passing more
+// than one value to a nested template:
+// {{template "comment" dict "Comment" . "Page" $}}
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict needs an even number of arguments")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, errors.New("dict keys must be strings")
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
+// formatTime is how dates and times are shown on pages
+func formatTime(t time.Time) string {
+	return t.Format("January 2, 2006, 15:04:05")
+}
+
+// userURL links to a user's profile page
+func userURL(username string) string {
+	return "/user/" + url.PathEscape(username)
+}
+
+// loadTemplates parses every page with the layout and partials and swaps
+// them in for the ones in use
+func loadTemplates() error {
+	shared, err := template.New("layout").Funcs(templateFuncs).ParseFiles(filepath.Join(TemplateDir, "layout.html"))
+	if err != nil {
+		return err
+	}
+	partials, err := filepath.Glob(filepath.Join(TemplateDir, "partials", "*.html"))
+	if err != nil {
+		return err
+	}
+	if len(partials) > 0 {
+		if _, err := shared.ParseFiles(partials...); err != nil {
+			return err
+		}
+	}
+
+	pages, err := filepath.Glob(filepath.Join(TemplateDir, "*.html"))
+	if err != nil {
+		return err
+	}
+	parsed := make(map[string]*template.Template, len(pages))
+	for _, page := range pages {
+		name := filepath.Base(page)
+		if name == "layout.html" {
+			continue
+		}
+		tmpl, err := shared.Clone()
+		if err != nil {
+			return err
+		}
+		if _, err := tmpl.ParseFiles(page); err != nil {
+			return err
+		}
+		parsed[name] = tmpl
+	}
+
+	templatesMu.Lock()
+	templates = parsed
+	templatesMu.Unlock()
+	return nil
+}
+
+// renderTemplate executes a page inside the layout. The page is rendered
+// into a buffer first so a failing template does not send half a page.
+func renderTemplate(w http.ResponseWriter, name string, data interface{}) {
+	if TemplateReload {
+		if err := loadTemplates(); err != nil {
+			log.Println(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	templatesMu.RLock()
+	tmpl, ok := templates[name]
+	templatesMu.RUnlock()
+	if !ok {
+		log.Println("no such template:", name)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Println(err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
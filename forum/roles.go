@@ -0,0 +1,158 @@
+package forum
+
+import (
+	"log"
+	"net/http"
+)
+
+// roles a user can have, from least to most trusted. Visitors who are not
+// logged in are guests.
+type Role string
+
+const (
+	RoleGuest         Role = "guest"
+	RoleUser          Role = "user"
+	RoleModerator     Role = "moderator"
+	RoleAdministrator Role = "administrator"
+)
+
+// permissions handlers check with User.Can
+const (
+	PermPostCreate         = "post.create"
+	PermPostEditOwn        = "post.edit.own"
+	PermPostEditAny        = "post.edit.any"
+	PermPostDeleteOwn      = "post.delete.own"
+	PermPostDeleteAny      = "post.delete.any"
+	PermPostLock           = "post.lock"
+	PermCommentCreate      = "comment.create"
+	PermCommentEditOwn     = "comment.edit.own"
+	PermCommentEditAny     = "comment.edit.any"
+	PermCommentDeleteOwn   = "comment.delete.own"
+	PermCommentDeleteAny   = "comment.delete.any"
+	PermCommentHide        = "comment.hide"
+	PermReactionCreate     = "reaction.create"
+	PermReactionDislike    = "reaction.dislike"
+	PermCategoryCreate     = "category.create"
+	PermUserBan            = "user.ban"
+	PermUserSetRole        = "user.role.set"
+	PermUserResetTwoFactor = "user.2fa.reset"
+)
+
+// roles in order, used to validate input and to list them in forms
+var Roles = []Role{RoleUser, RoleModerator, RoleAdministrator}
+
+// what each role may do; every role also has the permissions of the roles
+// before it
+var rolePermissions = map[Role][]string{
+	RoleGuest: {},
+	RoleUser: {
+		PermPostCreate, PermPostEditOwn, PermPostDeleteOwn,
+		PermCommentCreate, PermCommentEditOwn, PermCommentDeleteOwn,
+		PermReactionCreate,
+	},
+	RoleModerator: {
+		PermPostEditAny, PermPostDeleteAny, PermPostLock,
+		PermCommentEditAny, PermCommentDeleteAny, PermCommentHide,
+		PermReactionDislike, PermUserBan,
+	},
+	RoleAdministrator: {
+		PermCategoryCreate, PermUserSetRole, PermUserResetTwoFactor,
+	},
+}
+
+// every permission, for building template flags
+var allPermissions = func() []string {
+	var perms []string
+	for _, role := range append([]Role{RoleGuest}, Roles...) {
+		perms = append(perms, rolePermissions[role]...)
+	}
+	return perms
+}()
+
+// rank orders roles so that higher roles inherit from lower ones
+func (role Role) rank() int {
+	switch role {
+	case RoleUser:
+		return 1
+	case RoleModerator:
+		return 2
+	case RoleAdministrator:
+		return 3
+	}
+	return 0
+}
+
+func (role Role) valid() bool {
+	return role.rank() > 0
+}
+
+// Can reports whether a role grants the permission
+func (role Role) Can(perm string) bool {
+	for _, r := range append([]Role{RoleGuest}, Roles...) {
+		if r.rank() > role.rank() {
+			break
+		}
+		for _, p := range rolePermissions[r] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Can reports whether the user has the permission. A nil user is a guest.
+func (u *User) Can(perm string) bool {
+	if u == nil || u.Banned {
+		return RoleGuest.Can(perm)
+	}
+	return u.Role.Can(perm) || karmaAllows(u, perm)
+}
+
+// canModify reports whether the user may change something written by
+// authorID, either as its author or through the permission for anyone's
+func canModify(u *User, authorID int, own, any string) bool {
+	if u.Can(any) {
+		return true
+	}
+	return u != nil && u.ID == authorID && u.Can(own)
+}
+
+// permissionFlags lists every permission and whether the user has it, so
+// templates can write {{if index .Can "post.lock"}}
+func permissionFlags(u *User) map[string]bool {
+	flags := make(map[string]bool, len(allPermissions))
+	for _, perm := range allPermissions {
+		flags[perm] = u.Can(perm)
+	}
+	return flags
+}
+
+// RequirePermission stops requests from users without the permission. It
+// must run inside RequireAuth or WithUser.
+func RequirePermission(perm string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := CurrentUser(r)
+		if !user.Can(perm) {
+			if user == nil && !wantsJSON(r) {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// promoteAdmin makes the account with this email an administrator, so a
+// fresh install has someone who can hand out roles (FORUM_ADMIN_EMAIL)
+func promoteAdmin(email string) {
+	if email == "" {
+		return
+	}
+	_, err := DB.Exec("UPDATE Users SET Role = ? WHERE Email = ? COLLATE NOCASE", RoleAdministrator, email)
+	if err != nil {
+		log.Println("Error promoting administrator:", err)
+	}
+}
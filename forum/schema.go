@@ -0,0 +1,298 @@
+package forum
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// a migration brings the database schema forward by one step
+type migration func(tx *sql.Tx) error
+
+// execMigration builds a migration from plain SQL statements
+func execMigration(stmts ...string) migration {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrations are applied in order, and the index of the last applied one is
+// kept in PRAGMA user_version. Only ever append to this list.
+var migrations = []migration{
+	// server-side sessions, replacing Users.SessionID
+	execMigration(
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY,
+			token TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions(user_id)`,
+		`UPDATE Users SET SessionID = NULL`,
+	),
+	// store session tokens hashed; existing sessions are dropped
+	execMigration(
+		`DROP TABLE sessions`,
+		`CREATE TABLE sessions (
+			id INTEGER PRIMARY KEY,
+			token_hash TEXT NOT NULL UNIQUE,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL,
+			last_seen_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX sessions_user_id ON sessions(user_id)`,
+	),
+	// single-use tokens for password resets and email verification
+	execMigration(
+		`CREATE TABLE tokens (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			purpose TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX tokens_user_purpose ON tokens(user_id, purpose)`,
+	),
+	// email verification; accounts that already exist count as verified
+	execMigration(
+		`ALTER TABLE Users ADD COLUMN EmailVerified INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE Users SET EmailVerified = 1`,
+	),
+	// usernames and emails are unique regardless of case
+	execMigration(
+		`CREATE UNIQUE INDEX users_username_unique ON Users(Username COLLATE NOCASE)`,
+		`CREATE UNIQUE INDEX users_email_unique ON Users(Email COLLATE NOCASE)`,
+	),
+	// external OAuth2 accounts linked to users
+	execMigration(
+		`CREATE TABLE user_identities (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			provider TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			email TEXT,
+			created_at DATETIME NOT NULL,
+			UNIQUE(provider, subject),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX user_identities_user_id ON user_identities(user_id)`,
+	),
+	// TOTP two-factor authentication
+	execMigration(
+		`ALTER TABLE Users ADD COLUMN TOTPSecret TEXT`,
+		`ALTER TABLE Users ADD COLUMN TOTPEnabled INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE Users ADD COLUMN TOTPLastStep INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE recovery_codes (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX recovery_codes_user_id ON recovery_codes(user_id)`,
+	),
+	// login attempts for brute-force protection
+	execMigration(
+		`CREATE TABLE login_attempts (
+			id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			success INTEGER NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX login_attempts_email ON login_attempts(email, created_at)`,
+		`CREATE INDEX login_attempts_ip ON login_attempts(ip, created_at)`,
+	),
+	// roles, bans and locked posts
+	execMigration(
+		`ALTER TABLE Users ADD COLUMN Role TEXT NOT NULL DEFAULT 'user'`,
+		`ALTER TABLE Users ADD COLUMN Banned INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE posts ADD COLUMN locked INTEGER NOT NULL DEFAULT 0`,
+	),
+	// editing and soft-deleting posts
+	execMigration(
+		`ALTER TABLE posts ADD COLUMN edited_at DATETIME`,
+		`ALTER TABLE posts ADD COLUMN deleted_at DATETIME`,
+		`ALTER TABLE posts ADD COLUMN deleted_by INTEGER`,
+		`CREATE TABLE post_revisions (
+			id INTEGER PRIMARY KEY,
+			post_id INTEGER NOT NULL,
+			editor_id INTEGER,
+			title TEXT NOT NULL,
+			content TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY(post_id) REFERENCES posts(id),
+			FOREIGN KEY(editor_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX post_revisions_post_id ON post_revisions(post_id, created_at)`,
+	),
+	// editing, deleting and hiding comments
+	execMigration(
+		`ALTER TABLE comments ADD COLUMN edited_at DATETIME`,
+		`ALTER TABLE comments ADD COLUMN deleted_at DATETIME`,
+		`ALTER TABLE comments ADD COLUMN deleted_by INTEGER`,
+		`ALTER TABLE comments ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0`,
+		`CREATE INDEX comments_post_id ON comments(post_id, created_at)`,
+	),
+	// threaded replies
+	execMigration(
+		`ALTER TABLE comments ADD COLUMN parent_id INTEGER REFERENCES comments(id)`,
+		`CREATE INDEX comments_parent_id ON comments(parent_id)`,
+	),
+	// one reactions table for posts and comments, replacing postlikes and
+	// the old comment-only reactions table. Rows with type 0 were taken
+	// back and are dropped; counters are recomputed from what is left.
+	execMigration(
+		`ALTER TABLE reactions RENAME TO legacy_comment_reactions`,
+		`CREATE TABLE reactions (
+			id INTEGER PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			target_type TEXT NOT NULL,
+			target_id INTEGER NOT NULL,
+			kind TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			UNIQUE(user_id, target_type, target_id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		)`,
+		`CREATE INDEX reactions_target ON reactions(target_type, target_id, kind)`,
+		`INSERT OR IGNORE INTO reactions (user_id, target_type, target_id, kind, created_at)
+			SELECT CAST(user_id AS INTEGER), 'post', post_id, CASE type WHEN 1 THEN 'like' ELSE 'dislike' END, CURRENT_TIMESTAMP
+			FROM postlikes WHERE type IN (1, -1) AND user_id IS NOT NULL AND post_id IS NOT NULL
+			ORDER BY id DESC`,
+		`INSERT OR IGNORE INTO reactions (user_id, target_type, target_id, kind, created_at)
+			SELECT CAST(user_id AS INTEGER), 'comment', comment_id, CASE type WHEN 1 THEN 'like' ELSE 'dislike' END, CURRENT_TIMESTAMP
+			FROM legacy_comment_reactions WHERE type IN (1, -1) AND user_id IS NOT NULL AND comment_id IS NOT NULL
+			ORDER BY id DESC`,
+		`DROP TABLE postlikes`,
+		`DROP TABLE legacy_comment_reactions`,
+		`ALTER TABLE comments ADD COLUMN likes_count INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE comments ADD COLUMN dislikes_count INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE posts SET
+			likes_count = (SELECT COUNT(*) FROM reactions WHERE target_type = 'post' AND target_id = posts.id AND kind = 'like'),
+			dislikes_count = (SELECT COUNT(*) FROM reactions WHERE target_type = 'post' AND target_id = posts.id AND kind = 'dislike')`,
+		`UPDATE comments SET
+			likes_count = (SELECT COUNT(*) FROM reactions WHERE target_type = 'comment' AND target_id = comments.id AND kind = 'like'),
+			dislikes_count = (SELECT COUNT(*) FROM reactions WHERE target_type = 'comment' AND target_id = comments.id AND kind = 'dislike')`,
+	),
+	// karma, backfilled from existing reactions. The CASE below is a copy of
+	// the default KarmaWeights as they were when this was written; it does
+	// not follow FORUM_KARMA_WEIGHTS or later changes to the defaults, and
+	// like any applied migration it is never run again.
+	execMigration(
+		`ALTER TABLE Users ADD COLUMN Karma INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE Users SET Karma = COALESCE((
+			SELECT SUM(CASE r.kind WHEN 'like' THEN 1 WHEN 'love' THEN 2 WHEN 'laugh' THEN 1 WHEN 'wow' THEN 1 WHEN 'dislike' THEN -1 ELSE 0 END)
+			FROM reactions r
+			LEFT JOIN posts p ON r.target_type = 'post' AND p.id = r.target_id
+			LEFT JOIN comments c ON r.target_type = 'comment' AND c.id = r.target_id
+			WHERE COALESCE(p.user_id, c.user_id) = Users.ID AND r.user_id != Users.ID
+		), 0)`,
+	),
+	// posts can be in several categories. posts.category_id is no longer
+	// written; its comma-separated names are moved to post_categories.
+	execMigration(
+		`ALTER TABLE categories ADD COLUMN label TEXT NOT NULL DEFAULT ''`,
+		`INSERT OR IGNORE INTO categories (name) VALUES
+			('lifestyle'), ('news'), ('gaming'), ('fashion'), ('music'), ('tv-movies')`,
+		`UPDATE categories SET label = CASE name
+			WHEN 'lifestyle' THEN 'Lifestyle'
+			WHEN 'news' THEN 'News'
+			WHEN 'gaming' THEN 'Gaming'
+			WHEN 'fashion' THEN 'Fashion'
+			WHEN 'music' THEN 'Music'
+			WHEN 'tv-movies' THEN 'TV/Movies'
+			ELSE name END
+		WHERE label = ''`,
+		`CREATE TABLE post_categories (
+			post_id INTEGER NOT NULL,
+			category_id INTEGER NOT NULL,
+			PRIMARY KEY(post_id, category_id),
+			FOREIGN KEY(post_id) REFERENCES posts(id),
+			FOREIGN KEY(category_id) REFERENCES categories(id)
+		)`,
+		`CREATE INDEX post_categories_category_id ON post_categories(category_id)`,
+	),
+	// file existing posts under their categories
+	backfillPostCategories,
+	// comment counts for sorting by most commented
+	execMigration(
+		`ALTER TABLE posts ADD COLUMN comments_count INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE posts SET comments_count = (SELECT COUNT(*) FROM comments WHERE post_id = posts.id AND deleted_at IS NULL)`,
+		`CREATE TRIGGER comments_count_insert AFTER INSERT ON comments BEGIN
+			UPDATE posts SET comments_count = comments_count + 1 WHERE id = new.post_id;
+		END`,
+		`CREATE TRIGGER comments_count_delete AFTER UPDATE OF deleted_at ON comments
+		WHEN old.deleted_at IS NULL AND new.deleted_at IS NOT NULL BEGIN
+			UPDATE posts SET comments_count = comments_count - 1 WHERE id = new.post_id;
+		END`,
+	),
+	// join dates; existing users get the date of their first known activity
+	execMigration(
+		`ALTER TABLE Users ADD COLUMN CreatedAt DATETIME`,
+		`UPDATE Users SET CreatedAt = (SELECT MIN(t) FROM (
+			SELECT datetime(created_at) AS t FROM posts WHERE user_id = Users.ID
+			UNION ALL SELECT datetime(created_at) FROM comments WHERE user_id = Users.ID
+			UNION ALL SELECT datetime(created_at) FROM user_identities WHERE user_id = Users.ID
+		))`,
+	),
+	// rendered Markdown, filled in the next time each row is read
+	execMigration(
+		`ALTER TABLE posts ADD COLUMN content_html TEXT`,
+		`ALTER TABLE posts ADD COLUMN content_html_version INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE comments ADD COLUMN content_html TEXT`,
+		`ALTER TABLE comments ADD COLUMN content_html_version INTEGER NOT NULL DEFAULT 0`,
+	),
+	// password reset requests, for rate limiting
+	execMigration(
+		`CREATE TABLE password_reset_requests (
+			id INTEGER PRIMARY KEY,
+			email TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX password_reset_requests_email ON password_reset_requests(email, created_at)`,
+		`CREATE INDEX password_reset_requests_ip ON password_reset_requests(ip, created_at)`,
+	),
+}
+
+// migrate applies any migrations the database has not seen yet
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if err := migrations[i](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA does not accept placeholders
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("applied database migration %d", i+1)
+	}
+	return nil
+}
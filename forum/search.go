@@ -0,0 +1,388 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchFTS is set when the SQLite build has FTS5. go-sqlite3 only includes
+// it with the sqlite_fts5 build tag, see README.md.
+var searchFTS bool
+
+// UnrankedSearch lets a binary built without FTS5 start anyway, searching
+// with LIKE and no ranking (FORUM_UNRANKED_SEARCH=1)
+var UnrankedSearch = false
+
+// full-text indexes over posts and comments, kept in step by triggers
+var searchSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(title, content, content='posts', content_rowid='id')`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_insert AFTER INSERT ON posts BEGIN
+		INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_delete AFTER DELETE ON posts BEGIN
+		INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS posts_fts_update AFTER UPDATE OF title, content ON posts BEGIN
+		INSERT INTO posts_fts(posts_fts, rowid, title, content) VALUES ('delete', old.id, old.title, old.content);
+		INSERT INTO posts_fts(rowid, title, content) VALUES (new.id, new.title, new.content);
+	END`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS comments_fts USING fts5(content, content='comments', content_rowid='id')`,
+	`CREATE TRIGGER IF NOT EXISTS comments_fts_insert AFTER INSERT ON comments BEGIN
+		INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS comments_fts_delete AFTER DELETE ON comments BEGIN
+		INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS comments_fts_update AFTER UPDATE OF content ON comments BEGIN
+		INSERT INTO comments_fts(comments_fts, rowid, content) VALUES ('delete', old.id, old.content);
+		INSERT INTO comments_fts(rowid, content) VALUES (new.id, new.content);
+	END`,
+}
+
+var (
+	errNoFTS5 = errors.New("SQLite was built without FTS5, which search needs: build with go build -tags sqlite_fts5, " +
+		"or set FORUM_UNRANKED_SEARCH=1 to search without ranking")
+	// with the indexes in place every insert into posts or comments would
+	// fail in the triggers with "no such module: fts5"
+	errNoFTS5Indexes = errors.New("the database has full-text search indexes but SQLite was built without FTS5: " +
+		"build with go build -tags sqlite_fts5")
+)
+
+// initSearch sets up the full-text indexes. It is safe to run on every
+// start: indexes are only created, and filled from existing rows, when
+// missing. This is not a migration because it depends on how the binary
+// was built.
+func initSearch(db *sql.DB) error {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+	if !fts5 {
+		// the indexes, their shadow tables and the triggers all have _fts in the name
+		var leftover bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name GLOB '*_fts*')").Scan(&leftover); err != nil {
+			return err
+		}
+		if leftover {
+			return errNoFTS5Indexes
+		}
+		if !UnrankedSearch {
+			return errNoFTS5
+		}
+		log.Println("SQLite was built without FTS5, search will not be ranked")
+		return nil
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'posts_fts')").Scan(&exists); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range searchSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		for _, stmt := range []string{
+			`INSERT INTO posts_fts(posts_fts) VALUES ('rebuild')`,
+			`INSERT INTO comments_fts(comments_fts) VALUES ('rebuild')`,
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	searchFTS = true
+	return nil
+}
+
+var (
+	errEmptySearch   = errors.New("please enter something to search for")
+	errBadSearchDate = errors.New("dates must look like 2006-01-02")
+)
+
+// a search and its filters; empty filters are ignored
+type SearchQuery struct {
+	Text     string
+	Category string // category name
+	Author   string // username
+	From     string // YYYY-MM-DD, inclusive
+	To       string // YYYY-MM-DD, inclusive
+}
+
+// a post or comment that matched a search
+type SearchResult struct {
+	Kind    string        `json:"kind"` // "post" or "comment"
+	PostID  int           `json:"post_id"`
+	Title   string        `json:"title"`
+	Snippet template.HTML `json:"snippet"` // matches in <mark>
+	Author  string        `json:"author"`
+	Time    time.Time     `json:"created"`
+	URL     string        `json:"url"`
+}
+
+// highlight markers FTS5 puts around matches. Escaping the snippet leaves
+// these control characters alone; a stray one in a post can at most add an
+// unmatched <mark>.
+const (
+	markStart = "\x01"
+	markEnd   = "\x02"
+)
+
+const searchLimit = 50
+
+func parseSearchQuery(r *http.Request) (SearchQuery, error) {
+	q := r.URL.Query()
+	sq := SearchQuery{
+		Text:     strings.TrimSpace(q.Get("q")),
+		Category: q.Get("category"),
+		Author:   strings.TrimSpace(q.Get("author")),
+		From:     q.Get("from"),
+		To:       q.Get("to"),
+	}
+	for _, d := range []string{sq.From, sq.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			return sq, errBadSearchDate
+		}
+	}
+	if sq.Text == "" {
+		return sq, errEmptySearch
+	}
+	return sq, nil
+}
+
+// searchTerms splits input into words and "quoted phrases"
+func searchTerms(text string) []string {
+	var terms []string
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			// inside quotes
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, phrase)
+			}
+			continue
+		}
+		terms = append(terms, strings.FieldsFunc(part, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})...)
+	}
+	return terms
+}
+
+// ftsQuery quotes every term so input is never read as FTS5 syntax. All
+// terms have to match; a quoted phrase has to match as a whole.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(t, `"`, `""`) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// searchFilters builds the conditions shared by post and comment searches.
+// created and author are the columns holding the row's date and author ID.
+func searchFilters(sq SearchQuery, created, author string) (string, []interface{}) {
+	var where string
+	var args []interface{}
+	if sq.Category != "" {
+		where += ` AND p.id IN (SELECT pc.post_id FROM post_categories pc
+			JOIN categories c ON c.id = pc.category_id WHERE c.name = ?)`
+		args = append(args, sq.Category)
+	}
+	if sq.Author != "" {
+		where += " AND " + author + " = (SELECT ID FROM Users WHERE Username = ? COLLATE NOCASE)"
+		args = append(args, sq.Author)
+	}
+	if sq.From != "" {
+		where += " AND date(" + created + ") >= ?"
+		args = append(args, sq.From)
+	}
+	if sq.To != "" {
+		where += " AND date(" + created + ") <= ?"
+		args = append(args, sq.To)
+	}
+	return where, args
+}
+
+// Search finds posts and comments matching sq, best matches first
+func Search(sq SearchQuery) ([]SearchResult, error) {
+	terms := searchTerms(sq.Text)
+	if len(terms) == 0 {
+		return nil, errEmptySearch
+	}
+
+	postWhere, postArgs := searchFilters(sq, "p.created_at", "p.user_id")
+	commentWhere, commentArgs := searchFilters(sq, "cm.created_at", "cm.user_id")
+
+	var query string
+	var args []interface{}
+	if searchFTS {
+		match := ftsQuery(terms)
+		// title matches count for more than body matches
+		query = `SELECT 'post', p.id, p.title, snippet(posts_fts, -1, ?, ?, '…', 16),
+				COALESCE(u.Username, '[unknown]'), p.created_at, bm25(posts_fts, 5.0, 1.0) AS rank
+			FROM posts_fts JOIN posts p ON p.id = posts_fts.rowid
+			LEFT JOIN Users u ON u.ID = p.user_id
+			WHERE posts_fts MATCH ? AND p.deleted_at IS NULL` + postWhere + `
+			UNION ALL
+			SELECT 'comment', p.id, p.title, snippet(comments_fts, 0, ?, ?, '…', 16),
+				COALESCE(u.Username, '[unknown]'), cm.created_at, bm25(comments_fts) AS rank
+			FROM comments_fts JOIN comments cm ON cm.id = comments_fts.rowid
+			JOIN posts p ON p.id = cm.post_id
+			LEFT JOIN Users u ON u.ID = cm.user_id
+			WHERE comments_fts MATCH ? AND cm.deleted_at IS NULL AND cm.hidden = 0 AND p.deleted_at IS NULL` + commentWhere + `
+			ORDER BY rank LIMIT ?`
+		args = append(args, markStart, markEnd, match)
+		args = append(args, postArgs...)
+		args = append(args, markStart, markEnd, match)
+		args = append(args, commentArgs...)
+	} else {
+		postLike, postLikeArgs := likeConditions(terms, "p.title || ' ' || p.content")
+		commentLike, commentLikeArgs := likeConditions(terms, "cm.content")
+		query = `SELECT 'post', p.id, p.title, p.content, COALESCE(u.Username, '[unknown]'), p.created_at
+			FROM posts p LEFT JOIN Users u ON u.ID = p.user_id
+			WHERE p.deleted_at IS NULL` + postLike + postWhere + `
+			UNION ALL
+			SELECT 'comment', p.id, p.title, cm.content, COALESCE(u.Username, '[unknown]'), cm.created_at
+			FROM comments cm JOIN posts p ON p.id = cm.post_id
+			LEFT JOIN Users u ON u.ID = cm.user_id
+			WHERE cm.deleted_at IS NULL AND cm.hidden = 0 AND p.deleted_at IS NULL` + commentLike + commentWhere + `
+			ORDER BY 6 DESC LIMIT ?`
+		args = append(args, postLikeArgs...)
+		args = append(args, postArgs...)
+		args = append(args, commentLikeArgs...)
+		args = append(args, commentArgs...)
+	}
+	args = append(args, searchLimit)
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		var snippet string
+		var rank float64
+		dest := []interface{}{&res.Kind, &res.PostID, &res.Title, &snippet, &res.Author, &res.Time}
+		if searchFTS {
+			dest = append(dest, &rank)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		if !searchFTS {
+			snippet = excerpt(snippet, 200)
+		}
+		res.Snippet = highlightSnippet(snippet)
+		res.URL = "/post/" + strconv.Itoa(res.PostID)
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+// likeConditions requires every term to appear in column, for searching
+// without FTS5
+func likeConditions(terms []string, column string) (string, []interface{}) {
+	var where string
+	var args []interface{}
+	for _, t := range terms {
+		where += " AND " + column + ` LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(t)+"%")
+	}
+	return where, args
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// excerpt shortens text to about n bytes without cutting a character
+func excerpt(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n] + "…"
+}
+
+// highlightSnippet escapes a snippet for HTML and turns the match markers
+// into <mark> tags
+func highlightSnippet(snippet string) template.HTML {
+	snippet = html.EscapeString(snippet)
+	return template.HTML(strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>").Replace(snippet))
+}
+
+// search page; the form is also on the home page
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		PageBase
+		Query   SearchQuery
+		Results []SearchResult
+		Error   string
+	}
+	data.PageBase = newPageBase(r)
+
+	sq, err := parseSearchQuery(r)
+	data.Query = sq
+	if err == errEmptySearch && r.URL.Query().Get("q") == "" {
+		// just show the form
+		renderTemplate(w, "search.html", data)
+		return
+	}
+	if err == nil {
+		data.Results, err = Search(sq)
+	}
+	if err != nil {
+		if err != errEmptySearch && err != errBadSearchDate {
+			log.Println(err)
+			http.Error(w, "Could not search", http.StatusInternalServerError)
+			return
+		}
+		data.Error = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	renderTemplate(w, "search.html", data)
+}
+
+// the same search as JSON
+func SearchAPIHandler(w http.ResponseWriter, r *http.Request) {
+	sq, err := parseSearchQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := Search(sq)
+	if err == errEmptySearch {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not search", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []SearchResult `json:"results"`
+	}{results})
+}
@@ -0,0 +1,92 @@
+//go:build sqlite_fts5
+
+package forum
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchRanking(t *testing.T) {
+	openTestDB(t)
+	ids := searchFixture(t)
+	if !searchFTS {
+		t.Fatal("built with sqlite_fts5 but search does not use FTS5")
+	}
+
+	results, err := Search(SearchQuery{Text: "zorblax"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// among posts, a match in the title outweighs one in the body
+	var posts []int
+	for _, r := range results {
+		if r.Kind == "post" {
+			posts = append(posts, r.PostID)
+		}
+	}
+	if len(posts) != 4 || posts[0] != ids["title"] {
+		t.Errorf("posts in order %v, want %d first", posts, ids["title"])
+	}
+	for _, r := range results {
+		if strings.Contains(string(r.Snippet), "hidden") {
+			t.Error("a hidden comment was found")
+		}
+	}
+}
+
+func TestSearchSnippets(t *testing.T) {
+	openTestDB(t)
+	ids := searchFixture(t)
+	if _, err := DB.Exec("UPDATE posts SET content = ? WHERE id = ?", `<b>bold</b> zorblax & "quotes"`, ids["body"]); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := Search(SearchQuery{Text: "zorblax", Author: "bob", To: "2024-06-01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	want := `&lt;b&gt;bold&lt;/b&gt; <mark>zorblax</mark> &amp; &#34;quotes&#34;`
+	if got := string(results[0].Snippet); got != want {
+		t.Errorf("snippet %q, want %q", got, want)
+	}
+
+	results, err = Search(SearchQuery{Text: `"zorblax quux"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !strings.Contains(string(results[0].Snippet), "the <mark>zorblax quux</mark> arrived") {
+		t.Errorf("phrase search gave %+v", results)
+	}
+}
+
+func TestSearchFTS5Syntax(t *testing.T) {
+	openTestDB(t)
+	searchFixture(t)
+	// operators in the input are searched for as words, not run as FTS5
+	// syntax
+	for _, q := range []string{"zorblax OR", "zorblax NEAR(", "zorblax*", "title:zorblax", "-zorblax"} {
+		if _, err := Search(SearchQuery{Text: q}); err != nil {
+			t.Errorf("Search(%q): %v", q, err)
+		}
+	}
+}
+
+func TestInitSearchIndexesExistingRows(t *testing.T) {
+	openTestDB(t)
+	// posts already in the repository database were indexed on first start
+	results, err := Search(SearchQuery{Text: "radio"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Error("existing posts were not indexed")
+	}
+	// and starting again leaves the indexes alone
+	if err := initSearch(DB); err != nil {
+		t.Fatal(err)
+	}
+}
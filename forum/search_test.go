@@ -0,0 +1,146 @@
+package forum
+
+import (
+	"testing"
+	"time"
+)
+
+// searchFixture adds posts and comments with made-up words no other row
+// contains, and returns the post IDs by name
+func searchFixture(t *testing.T) map[string]int {
+	t.Helper()
+	alice := createTestUser(t, "alice@example.test", "alice", "password1", true)
+	bob := createTestUser(t, "bob@example.test", "bob", "password1", true)
+
+	posts := []struct {
+		name, title, content string
+		author               int
+		created              string
+		category             string
+	}{
+		{"title", "Zorblax gardening", "Tips for the spring.", alice, "2024-03-01", "lifestyle"},
+		{"body", "Weekend plans", "We talked about zorblax for a while.", bob, "2024-05-10", "news"},
+		{"phrase", "Quux notes", "the zorblax quux arrived late", alice, "2024-07-20", "gaming"},
+		{"split", "Other notes", "quux came before any zorblax did", bob, "2024-07-21", "gaming"},
+	}
+	ids := map[string]int{}
+	for _, p := range posts {
+		created, err := time.Parse("2006-01-02", p.created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := DB.Exec("INSERT INTO posts (user_id, title, content, created_at) VALUES (?, ?, ?, ?)", p.author, p.title, p.content, created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := res.LastInsertId()
+		ids[p.name] = int(id)
+		_, err = DB.Exec("INSERT INTO post_categories (post_id, category_id) SELECT ?, id FROM categories WHERE name = ?", id, p.category)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		post    string
+		content string
+		hidden  bool
+	}{
+		{"body", "Another zorblax fan here", false},
+		{"title", "this zorblax comment was hidden", true},
+	} {
+		_, err := DB.Exec("INSERT INTO comments (post_id, user_id, content, created_at, updated_at, hidden) VALUES (?, ?, ?, ?, ?, ?)",
+			ids[c.post], alice, c.content, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Now(), c.hidden)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+// matches lists results as "post:name" or "comment:name" by the post
+// they belong to
+func matches(ids map[string]int, results []SearchResult) map[string]bool {
+	names := map[int]string{}
+	for name, id := range ids {
+		names[id] = name
+	}
+	got := map[string]bool{}
+	for _, r := range results {
+		got[r.Kind+":"+names[r.PostID]] = true
+	}
+	return got
+}
+
+func TestSearchFilters(t *testing.T) {
+	openTestDB(t)
+	ids := searchFixture(t)
+
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  []string
+	}{
+		{"all", SearchQuery{Text: "zorblax"}, []string{"post:title", "post:body", "post:phrase", "post:split", "comment:body"}},
+		{"every word must match", SearchQuery{Text: "zorblax quux"}, []string{"post:phrase", "post:split"}},
+		{"phrase", SearchQuery{Text: `"zorblax quux"`}, []string{"post:phrase"}},
+		{"category", SearchQuery{Text: "zorblax", Category: "gaming"}, []string{"post:phrase", "post:split"}},
+		{"author", SearchQuery{Text: "zorblax", Author: "BOB"}, []string{"post:body", "post:split"}},
+		{"from", SearchQuery{Text: "zorblax", From: "2024-07-21"}, []string{"post:split"}},
+		{"to", SearchQuery{Text: "zorblax", To: "2024-03-01"}, []string{"post:title"}},
+		{"date range", SearchQuery{Text: "zorblax", From: "2024-05-01", To: "2024-06-30"}, []string{"post:body", "comment:body"}},
+		{"no match", SearchQuery{Text: "zorblax", Author: "nobody"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Search(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := matches(ids, results)
+			if len(got) != len(tt.want) || len(results) != len(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for _, w := range tt.want {
+				if !got[w] {
+					t.Errorf("missing %s in %v", w, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchEmpty(t *testing.T) {
+	openTestDB(t)
+	if _, err := Search(SearchQuery{Text: "?! -"}); err != errEmptySearch {
+		t.Errorf("err = %v, want errEmptySearch", err)
+	}
+}
+
+func TestInitSearchWithoutFTS5(t *testing.T) {
+	openTestDB(t)
+	var fts5 bool
+	if err := DB.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		t.Fatal(err)
+	}
+	if fts5 {
+		t.Skip("SQLite was built with FTS5")
+	}
+
+	UnrankedSearch = false
+	if err := initSearch(DB); err != errNoFTS5 {
+		t.Errorf("initSearch without FORUM_UNRANKED_SEARCH = %v, want errNoFTS5", err)
+	}
+	UnrankedSearch = true
+	if err := initSearch(DB); err != nil {
+		t.Fatalf("initSearch with FORUM_UNRANKED_SEARCH: %v", err)
+	}
+
+	// left behind by a binary that was built with FTS5
+	if _, err := DB.Exec("CREATE TABLE posts_fts_data (id INTEGER PRIMARY KEY, block BLOB)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := initSearch(DB); err != errNoFTS5Indexes {
+		t.Errorf("initSearch with leftover indexes = %v, want errNoFTS5Indexes", err)
+	}
+}
@@ -0,0 +1,188 @@
+package forum
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// name of the cookie that carries the session token
+const sessionCookieName = "session"
+
+var ErrNoSession = errors.New("no valid session")
+
+// a server-side login session. Token is only known when the session is
+// created or read from the cookie; the database keeps its hash.
+type Session struct {
+	ID         int
+	Token      string
+	UserID     int
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+// SessionManager stores sessions in the sessions table and resolves the
+// session cookie to a user. The cookie only ever holds an opaque token.
+type SessionManager struct {
+	db *sql.DB
+	// Lifetime is the absolute time a session may live after login
+	Lifetime time.Duration
+	// IdleTimeout ends a session that has not been used for this long
+	IdleTimeout time.Duration
+}
+
+var Sessions *SessionManager
+
+func NewSessionManager(db *sql.DB) *SessionManager {
+	return &SessionManager{
+		db:          db,
+		Lifetime:    24 * time.Hour,
+		IdleTimeout: 1 * time.Hour,
+	}
+}
+
+// Create starts a new session for the user and sets the session cookie.
+// Other sessions belonging to the same user are left untouched.
+func (m *SessionManager) Create(w http.ResponseWriter, userID int) (*Session, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	s := &Session{
+		Token:      token,
+		UserID:     userID,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(m.Lifetime),
+	}
+
+	res, err := m.db.Exec("INSERT INTO sessions (token_hash, user_id, created_at, last_seen_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(s.Token), s.UserID, s.CreatedAt, s.LastSeenAt, s.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	s.ID = int(id)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    s.Token,
+		Expires:  s.ExpiresAt,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return s, nil
+}
+
+// Get looks up the session named by the request's cookie. Expired or idle
+// sessions are deleted and reported as ErrNoSession.
+func (m *SessionManager) Get(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoSession
+	}
+
+	hash := hashToken(cookie.Value)
+	var storedHash string
+	s := Session{Token: cookie.Value}
+	err = m.db.QueryRow("SELECT id, token_hash, user_id, created_at, last_seen_at, expires_at FROM sessions WHERE token_hash = ?", hash).
+		Scan(&s.ID, &storedHash, &s.UserID, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoSession
+		}
+		return nil, err
+	}
+	if !tokensEqual(hash, storedHash) {
+		return nil, ErrNoSession
+	}
+
+	now := time.Now()
+	if now.After(s.ExpiresAt) || now.Sub(s.LastSeenAt) > m.IdleTimeout {
+		m.delete(s.ID)
+		return nil, ErrNoSession
+	}
+
+	// only write back once a minute so every request is not a write
+	if now.Sub(s.LastSeenAt) > time.Minute {
+		if _, err := m.db.Exec("UPDATE sessions SET last_seen_at = ? WHERE id = ?", now, s.ID); err != nil {
+			log.Println("Error updating session:", err)
+		}
+		s.LastSeenAt = now
+	}
+	return &s, nil
+}
+
+// UserID resolves the request's session to the logged in user's ID
+func (m *SessionManager) UserID(r *http.Request) (int, error) {
+	s, err := m.Get(r)
+	if err != nil {
+		return 0, err
+	}
+	return s.UserID, nil
+}
+
+// Destroy ends the request's session and clears the cookie
+func (m *SessionManager) Destroy(w http.ResponseWriter, r *http.Request) {
+	m.revoke(r)
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookieName,
+		Value:  "",
+		MaxAge: -1, // Expire immediately
+		Path:   "/",
+	})
+}
+
+// DestroyAll ends every session belonging to the user, e.g. after a
+// password change
+func (m *SessionManager) DestroyAll(userID int) error {
+	_, err := m.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// DestroyAllTx is DestroyAll as part of a transaction that is still
+// holding the database's write lock
+func (m *SessionManager) DestroyAllTx(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	return err
+}
+
+// revoke deletes the request's session without touching the cookie
+func (m *SessionManager) revoke(r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if _, err := m.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(cookie.Value)); err != nil {
+			log.Println("Error clearing session from the database:", err)
+		}
+	}
+}
+
+func (m *SessionManager) delete(id int) {
+	if _, err := m.db.Exec("DELETE FROM sessions WHERE id = ?", id); err != nil {
+		log.Println("Error clearing session from the database:", err)
+	}
+}
+
+// DeleteExpired removes sessions that can no longer be used
+func (m *SessionManager) DeleteExpired() error {
+	now := time.Now()
+	_, err := m.db.Exec("DELETE FROM sessions WHERE expires_at < ? OR last_seen_at < ?", now, now.Add(-m.IdleTimeout))
+	return err
+}
+
+// cleanup periodically deletes expired sessions
+func (m *SessionManager) cleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := m.DeleteExpired(); err != nil {
+			log.Println("Error deleting expired sessions:", err)
+		}
+	}
+}
@@ -2,49 +2,137 @@ package forum
 
 import (
 	"database/sql"
+	"html/template"
 	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 var DB *sql.DB
 
+// address the forum is reachable at, used for links in emails
+var BaseURL = "http://localhost:8080"
+
+// envOr reads an environment variable, falling back to def when unset
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer environment variable, falling back to def when
+// unset or invalid
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("ignoring %s=%q: not a number", key, v)
+		return def
+	}
+	return n
+}
+
+// struct for a registered user
+type User struct {
+	ID            int
+	Email         string
+	Username      string
+	EmailVerified bool
+	Role          Role
+	Banned        bool
+	Karma         int // earned from reactions to the user's posts and comments
+}
+
 // struct for individual posts
 type Post struct {
 	ID           string
+	UserID       int
 	Title        string
-	Content      string
-	Time         string
+	Content      string        // Markdown source
+	ContentHTML  template.HTML // rendered and sanitized
+	Time         time.Time
 	LikesCount   int // added JB
 	DislikeCount int // added JB
 	URL          string
-	// Author  string
+	Locked       bool      // no new comments
+	EditedAt     time.Time // zero if the post was never edited
+	Categories   []Category
+	Author       string // username, empty if the account is gone
+	AuthorKarma  int
 }
 
 // struct for comments
 type Comment struct {
-	UserID  string //
-	PostID  string //
-	Content string
-	Time    string
-	// Author  string
+	ID          int
+	UserID      int
+	PostID      string        //
+	Content     string        // Markdown source
+	ContentHTML template.HTML // rendered and sanitized
+	Time        time.Time
+	EditedAt    time.Time // zero if the comment was never edited
+	Deleted     bool      // shown as a placeholder
+	Hidden      bool      // hidden by a moderator
+	Likes       int
+	Dislikes    int
+	Reactions   []ReactionCount
+	ParentID    int // 0 for top-level comments
+	Depth       int // 0 for top-level comments
+	Replies     []*Comment
+	CanReply    bool
+	// what the viewing user may do with the comment
+	CanEdit     bool
+	CanDelete   bool
+	Author      string // username, empty if the account is gone
+	AuthorKarma int
+}
+
+// fields every page template can use
+type PageBase struct {
+	CSRFToken   string          // goes in a hidden csrf_token field in every POST form
+	CurrentUser *User           // nil for guests
+	Can         map[string]bool // permission flags, e.g. {{if index .Can "post.lock"}}
+	Categories  []Category      // for category pickers and filters
+}
+
+func newPageBase(r *http.Request) PageBase {
+	user := CurrentUser(r)
+	categories, err := getCategories()
+	if err != nil {
+		log.Println("Error loading categories:", err)
+	}
+	return PageBase{
+		CSRFToken:   CSRFToken(r),
+		CurrentUser: user,
+		Can:         permissionFlags(user),
+		Categories:  categories,
+	}
 }
 
 // struct for posts
 type HomePageData struct {
-	Posts      []Post // Replace with your actual Post type
-	IsLoggedIn bool   // Add this field to indicate whether the user is logged in
+	PageBase
+	Posts             []Post // Replace with your actual Post type
+	NeedsVerification bool   // logged in but the email address is not confirmed yet
+	Links             pageLinks
 }
 
 type PostPageData struct {
 	Post     *Post
-	Comments []Comment // added
-	Success  bool      // For displaying the success message
+	Comments []*Comment // added
+	Success  bool       // For displaying the success message
 }
 
 // struct to contain comments
 type CommentsData struct {
-	Comment []Comment
+	Comment []*Comment
 }
 
 // var comments []Comment
@@ -54,14 +142,42 @@ type CommentsData struct {
 // initialise DB
 func Init() {
 	var err error
-	DB, err = sql.Open("sqlite3", "./database.db")
+	DB, err = sql.Open("sqlite3", "./database.db?_txlock=immediate&_busy_timeout=5000")
 	if err != nil {
 		log.Fatal(err)
 	}
 	// defer DB.Close()
+
+	if err := migrate(DB); err != nil {
+		log.Fatal(err)
+	}
+	UnrankedSearch = os.Getenv("FORUM_UNRANKED_SEARCH") == "1"
+	if err := initSearch(DB); err != nil {
+		log.Fatal(err)
+	}
+
+	TemplateReload = os.Getenv("FORUM_TEMPLATE_RELOAD") == "1"
+	if err := loadTemplates(); err != nil {
+		log.Fatal(err)
+	}
+
+	Sessions = NewSessionManager(DB)
+	go Sessions.cleanup(10 * time.Minute)
+	go cleanupLoginAttempts(time.Hour)
+
+	BaseURL = envOr("FORUM_BASE_URL", BaseURL)
+	RequireVerifiedEmail = os.Getenv("FORUM_REQUIRE_VERIFIED_EMAIL") == "1"
+	MaxCommentDepth = envInt("FORUM_MAX_COMMENT_DEPTH", MaxCommentDepth)
+	PostsPerPage = envInt("FORUM_POSTS_PER_PAGE", PostsPerPage)
+	Mail = newMailerFromEnv()
+	configureOAuthFromEnv()
+	configureReactionKindsFromEnv()
+	configureKarmaFromEnv()
+	promoteAdmin(os.Getenv("FORUM_ADMIN_EMAIL"))
 }
 
 func Shutdown() {
+	pendingMail.Wait()
 	if DB != nil {
 		if err := DB.Close(); err != nil {
 			log.Fatal(err)
@@ -0,0 +1,137 @@
+package forum
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// number of random bytes behind every token (256 bits)
+const tokenBytes = 32
+
+// what a stored token may be used for
+const (
+	tokenPasswordReset     = "password_reset"
+	tokenEmailVerification = "email_verification"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// generateToken returns a random URL-safe token from crypto/rand. It is used
+// for session IDs, CSRF tokens and the one-off tokens in the tokens table.
+func generateToken() (string, error) {
+	b := make([]byte, tokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what gets stored in the database in place of the token, so
+// a leaked database cannot be used to log in or reset passwords
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokensEqual compares two tokens or token hashes in constant time
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// issueToken creates a single-use token for the user that expires after ttl.
+// Earlier unused tokens with the same purpose are revoked.
+func issueToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = tx.Exec("INSERT INTO tokens (user_id, purpose, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		userID, purpose, hashToken(token), now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// lookupToken returns the user a valid token was issued to without using it up
+func lookupToken(token, purpose string) (int, error) {
+	_, userID, err := findToken(DB, token, purpose)
+	return userID, err
+}
+
+// consumeToken checks a token and marks it used, returning the user it was
+// issued to. A token can only be consumed once.
+func consumeToken(token, purpose string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, err := consumeTokenTx(tx, token, purpose)
+	if err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// consumeTokenTx is consumeToken as part of a larger transaction; the token
+// only stays used if the transaction is committed
+func consumeTokenTx(tx *sql.Tx, token, purpose string) (int, error) {
+	id, userID, err := findToken(tx, token, purpose)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("UPDATE tokens SET used_at = ? WHERE id = ? AND used_at IS NULL", time.Now(), id)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return 0, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func findToken(q queryRower, token, purpose string) (id, userID int, err error) {
+	if token == "" {
+		return 0, 0, ErrInvalidToken
+	}
+	hash := hashToken(token)
+
+	var storedHash string
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err = q.QueryRow("SELECT id, user_id, token_hash, expires_at, used_at FROM tokens WHERE token_hash = ? AND purpose = ?", hash, purpose).
+		Scan(&id, &userID, &storedHash, &expiresAt, &usedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, ErrInvalidToken
+		}
+		return 0, 0, err
+	}
+	if !tokensEqual(hash, storedHash) || usedAt.Valid || time.Now().After(expiresAt) {
+		return 0, 0, ErrInvalidToken
+	}
+	return id, userID, nil
+}
@@ -0,0 +1,65 @@
+package forum
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1. The RFC lists 8 digit codes; the 6 digit
+// code for the same step is their last six digits.
+var totpVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+var rfcSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPVectors(t *testing.T) {
+	for _, v := range totpVectors {
+		want := v.code[len(v.code)-totpDigits:]
+		now := time.Unix(v.unix, 0)
+		if got := hotp([]byte("12345678901234567890"), uint64(totpStep(now))); got != want {
+			t.Errorf("at %d: hotp = %s, want %s", v.unix, got, want)
+		}
+		step, ok := verifyTOTP(rfcSecret, want, 0, now)
+		if !ok || step != totpStep(now) {
+			t.Errorf("at %d: verifyTOTP(%s) = %d, %v", v.unix, want, step, ok)
+		}
+	}
+}
+
+func TestTOTPSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	code := hotp([]byte("12345678901234567890"), uint64(totpStep(now)))
+	for _, d := range []time.Duration{-totpPeriod * time.Second, totpPeriod * time.Second} {
+		if _, ok := verifyTOTP(rfcSecret, code, 0, now.Add(d)); !ok {
+			t.Errorf("code rejected %v away from its step", d)
+		}
+	}
+	if _, ok := verifyTOTP(rfcSecret, code, 0, now.Add(2*totpPeriod*time.Second)); ok {
+		t.Error("code accepted two steps later")
+	}
+}
+
+func TestTOTPReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step, ok := verifyTOTP(rfcSecret, "005924", 0, now)
+	if !ok {
+		t.Fatal("valid code rejected")
+	}
+	if _, ok := verifyTOTP(rfcSecret, "005924", step, now); ok {
+		t.Error("code accepted again after its step was used")
+	}
+	// nor can an older code be used once a later one has been
+	earlier := hotp([]byte("12345678901234567890"), uint64(step-1))
+	if _, ok := verifyTOTP(rfcSecret, earlier, step, now); ok {
+		t.Error("code from an earlier step accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package forum
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// name of the cookie that remembers a login waiting for its second step
+	loginTwoFactorCookieName = "login_2fa"
+	// how long the second login step may take
+	loginTwoFactorTTL = 5 * time.Minute
+	// token purpose for the pending login
+	tokenLoginTwoFactor = "login_2fa"
+	recoveryCodeCount   = 10
+)
+
+type twoFactorPageData struct {
+	PageBase
+	Enabled       bool
+	Secret        string       // shown while enrolling
+	URI           template.URL // otpauth:// link for authenticator apps
+	RecoveryCodes []string     // shown once, right after enabling
+	CodesLeft     int
+	Error         string
+}
+
+// show 2FA status, or start enrolling by showing a new secret
+func TwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+	data := twoFactorPageData{PageBase: newPageBase(r)}
+
+	var secret sql.NullString
+	err := DB.QueryRow("SELECT TOTPSecret, TOTPEnabled FROM Users WHERE ID = ?", user.ID).Scan(&secret, &data.Enabled)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if data.Enabled {
+		err = DB.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", user.ID).Scan(&data.CodesLeft)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		renderTemplate(w, "twoFactor.html", data)
+		return
+	}
+
+	// Keep the pending secret until it is confirmed, so reloading the page
+	// does not invalidate what was already scanned
+	if !secret.Valid || secret.String == "" {
+		secret.String, err = generateTOTPSecret()
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Could not create secret", http.StatusInternalServerError)
+			return
+		}
+		_, err = DB.Exec("UPDATE Users SET TOTPSecret = ? WHERE ID = ? AND TOTPEnabled = 0", secret.String, user.ID)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	data.Secret = secret.String
+	data.URI = template.URL(totpURI(user.Email, secret.String))
+	renderTemplate(w, "twoFactor.html", data)
+}
+
+// confirm enrollment with a code from the authenticator app
+func EnableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := CurrentUser(r)
+
+	var secret sql.NullString
+	var enabled bool
+	err := DB.QueryRow("SELECT TOTPSecret, TOTPEnabled FROM Users WHERE ID = ?", user.ID).Scan(&secret, &enabled)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if enabled || !secret.Valid {
+		http.Redirect(w, r, "/account/2fa", http.StatusFound)
+		return
+	}
+
+	step, ok := verifyTOTP(secret.String, r.FormValue("code"), 0, time.Now())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "twoFactor.html", twoFactorPageData{
+			PageBase: newPageBase(r),
+			Secret:   secret.String,
+			URI:      template.URL(totpURI(user.Email, secret.String)),
+			Error:    "That code didn't match. Check the time on your device and try again.",
+		})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not create recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE Users SET TOTPEnabled = 1, TOTPLastStep = ? WHERE ID = ?", step, user.ID)
+	if err == nil {
+		err = replaceRecoveryCodes(tx, user.ID, codes)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, "twoFactor.html", twoFactorPageData{PageBase: newPageBase(r), Enabled: true, RecoveryCodes: codes, CodesLeft: len(codes)})
+}
+
+// turn 2FA off after confirming the password, or a code from the
+// authenticator or a recovery code. Accounts created through a provider
+// have a random password nobody knows.
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := CurrentUser(r)
+	data := twoFactorPageData{PageBase: newPageBase(r), Enabled: true}
+
+	// guessed against the same limits as logging in
+	email, ip := normalizeEmail(user.Email), clientIP(r)
+	wait, err := loginRetryAfter(email, ip, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		data.Error = tooManyLoginAttemptsMessage(wait)
+		tooManyLoginAttempts(w, "twoFactor.html", data, wait)
+		return
+	}
+
+	var ok bool
+	failed := "Incorrect password"
+	if code := r.FormValue("code"); code != "" {
+		ok, err = checkSecondFactor(user.ID, code)
+		failed = "That code didn't work"
+	} else {
+		var storedPassword []byte
+		err = DB.QueryRow("SELECT Password FROM Users WHERE ID = ?", user.ID).Scan(&storedPassword)
+		ok = err == nil && bcrypt.CompareHashAndPassword(storedPassword, []byte(r.FormValue("password"))) == nil
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	recordLoginAttempt(email, ip, ok)
+	if !ok {
+		data.Error = failed
+		w.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(w, "twoFactor.html", data)
+		return
+	}
+
+	if err := disableTOTP(user.ID); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/account/2fa", http.StatusFound)
+}
+
+// disableTOTP removes the user's secret and recovery codes. It is also what
+// an administrator uses for someone locked out of their account.
+func disableTOTP(userID int) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE Users SET TOTPSecret = NULL, TOTPEnabled = 0, TOTPLastStep = 0 WHERE ID = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		_, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startTwoFactorLogin is called once the password has been checked for a
+// user with 2FA on. The session is only created after the second step.
+func startTwoFactorLogin(w http.ResponseWriter, r *http.Request, userID int) {
+	token, err := issueToken(userID, tokenLoginTwoFactor, loginTwoFactorTTL)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not start login", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginTwoFactorCookieName,
+		Value:    token,
+		Path:     "/login",
+		MaxAge:   int(loginTwoFactorTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login/2fa", http.StatusFound)
+}
+
+// the second login step: a code from the authenticator or a recovery code
+func LoginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(loginTwoFactorCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	userId, err := lookupToken(cookie.Value, tokenLoginTwoFactor)
+	if err != nil {
+		if err != ErrInvalidToken {
+			log.Println(err)
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	var data struct {
+		PageBase
+		Error string
+	}
+	data.PageBase = newPageBase(r)
+	if r.Method == http.MethodGet {
+		renderTemplate(w, "loginTwoFactor.html", data)
+		return
+	}
+
+	// Codes are guessed against the same limits as passwords
+	user, err := getUserByID(userId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	email, ip := normalizeEmail(user.Email), clientIP(r)
+	wait, err := loginRetryAfter(email, ip, time.Now())
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if wait > 0 {
+		data.Error = tooManyLoginAttemptsMessage(wait)
+		tooManyLoginAttempts(w, "loginTwoFactor.html", data, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(userId, r.FormValue("code"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		recordLoginAttempt(email, ip, false)
+		data.Error = "That code didn't work. Try again or use a recovery code."
+		w.WriteHeader(http.StatusUnauthorized)
+		renderTemplate(w, "loginTwoFactor.html", data)
+		return
+	}
+	recordLoginAttempt(email, ip, true)
+
+	// the pending login can only be completed once
+	if _, err := consumeToken(cookie.Value, tokenLoginTwoFactor); err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginTwoFactorCookieName, Value: "", Path: "/login", MaxAge: -1})
+
+	Sessions.revoke(r)
+	if _, err := Sessions.Create(w, userId); err != nil {
+		log.Println(err)
+		http.Error(w, "Could not create session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code
+func checkSecondFactor(userID int, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := DB.QueryRow("SELECT TOTPSecret, TOTPLastStep FROM Users WHERE ID = ? AND TOTPEnabled = 1", userID).Scan(&secret, &lastStep)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if step, ok := verifyTOTP(secret, code, lastStep, time.Now()); ok {
+		// the WHERE clause stops two requests using the same code
+		res, err := DB.Exec("UPDATE Users SET TOTPLastStep = ? WHERE ID = ? AND TOTPLastStep < ?", step, userID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+
+	res, err := DB.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
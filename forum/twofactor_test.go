@@ -0,0 +1,100 @@
+package forum
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// enableTestTOTP turns 2FA on for the user with the RFC test secret and
+// one recovery code
+func enableTestTOTP(t *testing.T, userID int, recoveryCode string) {
+	t.Helper()
+	if _, err := DB.Exec("UPDATE Users SET TOTPSecret = ?, TOTPEnabled = 1 WHERE ID = ?", rfcSecret, userID); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := replaceRecoveryCodes(tx, userID, []string{recoveryCode}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func totpEnabled(t *testing.T, userID int) bool {
+	t.Helper()
+	var enabled bool
+	if err := DB.QueryRow("SELECT TOTPEnabled FROM Users WHERE ID = ?", userID).Scan(&enabled); err != nil {
+		t.Fatal(err)
+	}
+	return enabled
+}
+
+// asUser calls h as if the middleware had logged the user in
+func asUser(t *testing.T, userID int, h http.HandlerFunc) http.HandlerFunc {
+	user, err := getUserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, withUserContext(r, user))
+	}
+}
+
+func TestDisableTwoFactor(t *testing.T) {
+	code := func() string {
+		return hotp([]byte("12345678901234567890"), uint64(totpStep(time.Now())))
+	}
+	tests := []struct {
+		name string
+		form url.Values
+		want int
+	}{
+		{"password", url.Values{"password": {"password1"}}, http.StatusFound},
+		{"wrong password", url.Values{"password": {"password2"}}, http.StatusUnauthorized},
+		{"authenticator code", url.Values{"code": {code()}}, http.StatusFound},
+		{"recovery code", url.Values{"code": {"ABCD-EFGH"}}, http.StatusFound},
+		{"wrong code", url.Values{"code": {"000000"}}, http.StatusUnauthorized},
+		{"nothing", url.Values{}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			userID := createTestUser(t, "twofactor@example.test", "twofactor", "password1", true)
+			enableTestTOTP(t, userID, "abcd-efgh")
+
+			w := postForm(asUser(t, userID, DisableTwoFactorHandler), "/account/2fa/disable", tt.form)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if enabled := totpEnabled(t, userID); enabled != (tt.want != http.StatusFound) {
+				t.Errorf("2FA enabled = %v after status %d", enabled, w.Code)
+			}
+		})
+	}
+}
+
+func TestDisableTwoFactorCodeReplay(t *testing.T) {
+	openTestDB(t)
+	userID := createTestUser(t, "replay@example.test", "replay", "password1", true)
+	enableTestTOTP(t, userID, "abcd-efgh")
+
+	// a code used to log in cannot be used again to turn 2FA off
+	code := hotp([]byte("12345678901234567890"), uint64(totpStep(time.Now())))
+	if ok, err := checkSecondFactor(userID, code); err != nil || !ok {
+		t.Fatalf("checkSecondFactor = %v, %v", ok, err)
+	}
+	w := postForm(asUser(t, userID, DisableTwoFactorHandler), "/account/2fa/disable", url.Values{"code": {code}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if !totpEnabled(t, userID) {
+		t.Error("2FA was turned off with a replayed code")
+	}
+}
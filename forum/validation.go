@@ -0,0 +1,91 @@
+package forum
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	usernameMinLength = 3
+	usernameMaxLength = 20
+	passwordMinLength = 8
+	passwordMaxLength = 72 // bcrypt ignores anything longer
+	postMaxLength     = 40000
+	commentMaxLength  = 10000
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// per-field error messages for a form, keyed by input name
+type FormErrors map[string]string
+
+// validateEmail checks the address is a plain addr-spec like name@example.com
+func validateEmail(email string) string {
+	if email == "" {
+		return "Please enter your email address."
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "Please enter a valid email address."
+	}
+	return ""
+}
+
+func validateUsername(username string) string {
+	if len(username) < usernameMinLength || len(username) > usernameMaxLength {
+		return "Usernames must be between 3 and 20 characters long."
+	}
+	if !usernamePattern.MatchString(username) {
+		return "Usernames may only contain letters, numbers, '_' and '-'."
+	}
+	return ""
+}
+
+func validatePassword(password string) string {
+	if len(password) < passwordMinLength {
+		return "Passwords must be at least 8 characters long."
+	}
+	if len(password) > passwordMaxLength {
+		return "Passwords must be at most 72 characters long."
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return "Passwords must contain at least one letter and one number."
+	}
+	return ""
+}
+
+// validateRegistration checks every field of the registration form
+func validateRegistration(email, username, password string) FormErrors {
+	errs := FormErrors{}
+	if msg := validateEmail(email); msg != "" {
+		errs["email"] = msg
+	}
+	if msg := validateUsername(username); msg != "" {
+		errs["username"] = msg
+	}
+	if msg := validatePassword(password); msg != "" {
+		errs["password"] = msg
+	}
+	return errs
+}
+
+// validateLength limits Markdown that is rendered when it is saved
+func validateLength(field, content string, max int) string {
+	if utf8.RuneCountInString(content) > max {
+		return fmt.Sprintf("%s must be at most %d characters long.", field, max)
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package forum
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// how long an email verification link stays valid
+const emailVerificationTTL = 24 * time.Hour
+
+// when set, users must confirm their email address before posting,
+// commenting or reacting (FORUM_REQUIRE_VERIFIED_EMAIL=1)
+var RequireVerifiedEmail bool
+
+type verifyEmailData struct {
+	PageBase
+	Verified          bool // the link was valid and the address is now confirmed
+	Sent              bool // a new link was just sent
+	NeedsVerification bool // the user tried something that needs a confirmed address
+	Error             string
+}
+
+func sendVerificationEmail(userId int, email string) error {
+	token, err := issueToken(userId, tokenEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := BaseURL + "/verify-email?token=" + url.QueryEscape(token)
+	return Mail.Send(Message{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Thanks for joining the forum!\n\n"+
+			"Please confirm your email address by following this link within 24 hours:\n\n%s\n", link),
+	})
+}
+
+// confirm an email address with the link from the verification email
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	data := verifyEmailData{PageBase: newPageBase(r)}
+
+	userId, err := consumeToken(r.URL.Query().Get("token"), tokenEmailVerification)
+	if err != nil {
+		if err != ErrInvalidToken {
+			log.Println(err)
+		}
+		data.Error = "This verification link is invalid or has expired."
+		w.WriteHeader(http.StatusBadRequest)
+		renderTemplate(w, "verifyEmail.html", data)
+		return
+	}
+
+	_, err = DB.Exec("UPDATE Users SET EmailVerified = 1 WHERE ID = ?", userId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "Could not verify email", http.StatusInternalServerError)
+		return
+	}
+
+	data.Verified = true
+	renderTemplate(w, "verifyEmail.html", data)
+}
+
+// send the logged in user a fresh verification link
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := CurrentUser(r)
+	if user.EmailVerified {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	// issueToken revokes the previous link, so only the newest one works
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		log.Println("Error sending verification email:", err)
+		http.Error(w, "Could not send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	renderTemplate(w, "verifyEmail.html", verifyEmailData{PageBase: newPageBase(r), Sent: true})
+}